@@ -10,7 +10,9 @@ import (
 	"github.com/maskrapp/relay/internal/config"
 	"github.com/maskrapp/relay/internal/global"
 	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/maskrapp/relay/internal/smtp"
+	"github.com/maskrapp/relay/internal/store"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -33,16 +35,69 @@ func main() {
 		logrus.Panicf("grpc error: %s", err)
 	}
 
+	fileStore, err := store.NewFileStore(cfg.DataDir)
+	if err != nil {
+		logrus.Panicf("store error: %s", err)
+	}
+
+	dns, dnsCache := newResolver(cfg, cfg.DNS.Servers)
+	dnsbl, dnsblCache := dns, dnsCache
+	if len(cfg.DNS.DNSBLServers) > 0 {
+		dnsbl, dnsblCache = newResolver(cfg, cfg.DNS.DNSBLServers)
+	}
+
 	instances := &global.Instances{
-		GrpcClient: main_api.NewMainAPIServiceClient(conn),
+		GrpcClient:    main_api.NewMainAPIServiceClient(conn),
+		Store:         fileStore,
+		Resolver:      dns,
+		DNSBLResolver: dnsbl,
 	}
 
-	globalContext := global.NewContext(context.Background(), instances, cfg)
+	globalContext, cancel := global.WithCancel(global.NewContext(context.Background(), instances, cfg))
+	if dnsCache != nil && cfg.DNS.StatsInterval > 0 {
+		go dnsCache.LogStats(globalContext, "checks", cfg.DNS.StatsInterval)
+		if dnsblCache != dnsCache {
+			go dnsblCache.LogStats(globalContext, "dnsbl", cfg.DNS.StatsInterval)
+		}
+	}
 
 	server := smtp.New(globalContext)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go server.ListenAndServe()
 	<-sigChan
-	server.Shutdown(globalContext)
+	if err := server.Shutdown(globalContext); err != nil {
+		logrus.Errorf("error shutting down: %v", err)
+	}
+	cancel()
+}
+
+// newResolver returns a resolver that asks servers, or the name servers of the system when there are none, behind
+// a cache unless it is disabled. The system resolver is only used when /etc/resolv.conf lists no servers, since it
+// does not tell the TTLs of its answers.
+func newResolver(cfg *config.Config, servers []string) (resolver.Resolver, *resolver.Cache) {
+	var parsed []resolver.Server
+	var err error
+	if len(servers) > 0 {
+		parsed, err = resolver.ParseServers(servers)
+		if err != nil {
+			logrus.Panicf("dns server error: %s", err)
+		}
+	} else if parsed, err = resolver.SystemServers("/etc/resolv.conf"); err != nil {
+		logrus.Warnf("error reading /etc/resolv.conf, using the system resolver without TTLs: %s", err)
+	} else if len(parsed) == 0 {
+		logrus.Warn("no name servers in /etc/resolv.conf, using the system resolver without TTLs")
+	}
+	dns := resolver.Default
+	if len(parsed) > 0 {
+		dns = resolver.NewClient(parsed, cfg.DNS.Timeout)
+	}
+	if cfg.DNS.CacheSize <= 0 {
+		return dns, nil
+	}
+	cache := resolver.NewCache(dns, cfg.DNS.CacheSize)
+	cache.TTL = cfg.DNS.CacheTTL
+	cache.NegativeTTL = cfg.DNS.CacheNegativeTTL
+	cache.MaxTTL = cfg.DNS.CacheMaxTTL
+	return cache, cache
 }
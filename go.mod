@@ -4,10 +4,7 @@ go 1.19
 
 require blitiri.com.ar/go/spf v1.5.1
 
-require (
-	github.com/DusanKasan/parsemail v1.2.0
-	github.com/joho/godotenv v1.5.1
-)
+require github.com/joho/godotenv v1.5.1
 
 require (
 	github.com/armon/go-proxyproto v0.0.0-20210323213023-7e956b284f0a // indirect
@@ -17,7 +14,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
@@ -31,5 +27,9 @@ require (
 	github.com/stretchr/testify v1.8.2
 	golang.org/x/net v0.8.0
 	golang.org/x/sync v0.1.0
+	golang.org/x/text v0.8.0
 	google.golang.org/grpc v1.53.0
 )
+
+// smtpd with handler errors that carry their own reply, e.g. the permanent failure of a mail loop.
+replace github.com/maskrapp/smtpd => ./third_party/smtpd
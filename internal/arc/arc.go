@@ -0,0 +1,126 @@
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authenticated Received Chain (RFC 8617). Forwarding breaks SPF and often DKIM at the final destination,
+// an ARC set tells the destination what the relay saw when the message came in.
+
+var (
+	ErrInvalidKey   = errors.New("ARC private key must be a PEM encoded RSA or Ed25519 key")
+	ErrChainPresent = errors.New("message already has an ARC chain")
+)
+
+// signedHeaders are the header fields covered by ARC-Message-Signature, when present.
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+type Sealer struct {
+	domain    string
+	selector  string
+	signer    crypto.Signer
+	algorithm string
+}
+
+// NewSealer creates a sealer that signs as selector._domainkey.domain with the PEM encoded private key.
+func NewSealer(domain, selector string, privateKey []byte) (*Sealer, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	sealer := &Sealer{domain: domain, selector: selector}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sealer.signer, sealer.algorithm = key, "rsa-sha256"
+	case ed25519.PrivateKey:
+		sealer.signer, sealer.algorithm = key, "ed25519-sha256"
+	default:
+		return nil, ErrInvalidKey
+	}
+	return sealer, nil
+}
+
+// Seal returns the header fields of a new ARC set for raw, to be prepended to it.
+// authenticationResults is the value of the Authentication-Results header the set records.
+func (s *Sealer) Seal(raw []byte, authenticationResults string) ([]byte, error) {
+	fields, body := splitMessage(raw)
+	for _, v := range fields {
+		if strings.EqualFold(v.name, "ARC-Seal") {
+			return nil, ErrChainPresent
+		}
+	}
+	timestamp := time.Now().Unix()
+
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=1; %v\r\n", authenticationResults)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	var names []string
+	var input strings.Builder
+	for _, name := range signedHeaders {
+		// Repeated fields are signed from the bottom up.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				names = append(names, strings.ToLower(name))
+				input.WriteString(relaxedHeader(fields[i].raw))
+			}
+		}
+	}
+	ams := fmt.Sprintf("ARC-Message-Signature: i=1; a=%v; c=relaxed/relaxed; d=%v; s=%v; t=%v;\r\n\th=%v;\r\n\tbh=%v;\r\n\tb=",
+		s.algorithm, s.domain, s.selector, timestamp, strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	input.WriteString(strings.TrimSuffix(relaxedHeader(ams), "\r\n"))
+	signature, err := s.sign(input.String())
+	if err != nil {
+		return nil, err
+	}
+	ams += foldBase64(signature) + "\r\n"
+
+	seal := fmt.Sprintf("ARC-Seal: i=1; a=%v; cv=none; d=%v; s=%v; t=%v;\r\n\tb=", s.algorithm, s.domain, s.selector, timestamp)
+	signature, err = s.sign(relaxedHeader(aar) + relaxedHeader(ams) + strings.TrimSuffix(relaxedHeader(seal), "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	seal += foldBase64(signature) + "\r\n"
+
+	return []byte(seal + ams + aar), nil
+}
+
+func (s *Sealer) sign(input string) (string, error) {
+	digest := sha256.Sum256([]byte(input))
+	var opts crypto.SignerOpts = crypto.SHA256
+	// RFC 8463: Ed25519 signs the SHA-256 digest itself.
+	if s.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+	signature, err := s.signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
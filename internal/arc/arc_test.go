@@ -0,0 +1,95 @@
+package arc_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/arc"
+	"github.com/stretchr/testify/assert"
+)
+
+const message = "From: mask@maskr.app\r\n" +
+	"To: user@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello  world \r\n" +
+	"\r\n"
+
+// fakeResolver serves the TXT records of a fake zone.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func newSealer(t *testing.T) (*arc.Sealer, fakeResolver) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	sealer, err := arc.NewSealer("maskr.app", "arc", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.NoError(t, err)
+	return sealer, fakeResolver{
+		"arc._domainkey.maskr.app": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)},
+	}
+}
+
+func TestSeal(t *testing.T) {
+	sealer, _ := newSealer(t)
+	seal, err := sealer.Seal([]byte(message), "mx.maskr.app; spf=pass smtp.mailfrom=sender@example.com")
+	assert.NoError(t, err)
+
+	lines := strings.Split(string(seal), "\r\n")
+	assert.True(t, strings.HasPrefix(lines[0], "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=maskr.app; s=arc;"))
+	assert.Contains(t, string(seal), "ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed;")
+	assert.Contains(t, string(seal), "h=from:subject:to;")
+	assert.Contains(t, string(seal), "ARC-Authentication-Results: i=1; mx.maskr.app; spf=pass smtp.mailfrom=sender@example.com\r\n")
+
+	bodyHash := sha256.Sum256([]byte("Hello world\r\n"))
+	assert.Contains(t, string(seal), "bh="+base64.StdEncoding.EncodeToString(bodyHash[:])+";")
+
+	_, err = sealer.Seal(append(seal, message...), "mx.maskr.app; none")
+	assert.ErrorIs(t, err, arc.ErrChainPresent)
+}
+
+func TestNewSealerInvalidKey(t *testing.T) {
+	_, err := arc.NewSealer("maskr.app", "arc", []byte("not a key"))
+	assert.ErrorIs(t, err, arc.ErrInvalidKey)
+}
+
+func TestVerify(t *testing.T) {
+	sealer, resolver := newSealer(t)
+	verifier := &arc.Verifier{Resolver: resolver}
+	ctx := context.Background()
+
+	assert.Equal(t, arc.StatusNone, verifier.Verify(ctx, []byte(message)).Status)
+
+	seal, err := sealer.Seal([]byte(message), "mx.maskr.app; dmarc=pass header.from=example.com")
+	assert.NoError(t, err)
+	sealed := append(seal, message...)
+	verification := verifier.Verify(ctx, sealed)
+	assert.NoError(t, verification.Err)
+	assert.Equal(t, arc.StatusPass, verification.Status)
+	assert.Len(t, verification.Sets, 1)
+	assert.Equal(t, "maskr.app", verification.Sets[0].Domain)
+	assert.Equal(t, "mx.maskr.app; dmarc=pass header.from=example.com", verification.Sets[0].AuthenticationResults)
+	assert.Len(t, verification.Sets[0].Results(), 1)
+
+	// Whitespace changes survive relaxed canonicalization, content changes do not.
+	assert.Equal(t, arc.StatusPass, verifier.Verify(ctx, []byte(strings.Replace(string(sealed), "Subject: Hello", "Subject:   Hello", 1))).Status)
+	assert.Equal(t, arc.StatusFail, verifier.Verify(ctx, []byte(strings.Replace(string(sealed), "Hello  world", "Goodbye world", 1))).Status)
+	assert.Equal(t, arc.StatusFail, verifier.Verify(ctx, []byte(strings.Replace(string(sealed), "Subject: Hello", "Subject: Bye", 1))).Status)
+	assert.Equal(t, arc.StatusFail, (&arc.Verifier{Resolver: fakeResolver{}}).Verify(ctx, sealed).Status)
+}
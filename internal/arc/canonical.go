@@ -0,0 +1,98 @@
+package arc
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+var whitespaceRegex = regexp.MustCompile(`[ \t]+`)
+
+// field is a header field as it appears in the message, including folding.
+type field struct {
+	name string
+	raw  string
+}
+
+// splitMessage returns the header fields of raw and its body.
+func splitMessage(raw []byte) ([]field, []byte) {
+	header, body := raw, []byte(nil)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i != -1 {
+		header, body = raw[:i+2], raw[i+4:]
+	}
+	var fields []field
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if i := strings.Index(line, ":"); i != -1 {
+			name = line[:i]
+		}
+		fields = append(fields, field{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields, body
+}
+
+// relaxedHeader canonicalizes a header field with the relaxed algorithm of RFC 6376 section 3.4.2.
+func relaxedHeader(raw string) string {
+	name, value := raw, ""
+	if i := strings.Index(raw, ":"); i != -1 {
+		name, value = raw[:i], raw[i+1:]
+	}
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = whitespaceRegex.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value) + "\r\n"
+}
+
+// relaxedBody canonicalizes a message body with the relaxed algorithm of RFC 6376 section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(whitespaceRegex.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// parseTags parses a tag list like "i=1; a=rsa-sha256; b=..." (RFC 6376 section 3.2).
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, v := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(v, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(val), "")
+	}
+	return tags
+}
+
+// fieldValue returns the value of a header field without its name.
+func fieldValue(raw string) string {
+	if i := strings.Index(raw, ":"); i != -1 {
+		return raw[i+1:]
+	}
+	return ""
+}
+
+// foldBase64 splits a long base64 value over several lines.
+func foldBase64(value string) string {
+	var b strings.Builder
+	for len(value) > 72 {
+		b.WriteString(value[:72])
+		b.WriteString("\r\n\t")
+		value = value[72:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package arc
+
+import (
+	"context"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/sirupsen/logrus"
+)
+
+// Forwarder seals messages with the verdicts of the checks before handing them to the delivery backend.
+// Only backends that deliver the rendered message as is can carry the seal.
+type Forwarder struct {
+	next   mailer.Forwarder
+	sealer *Sealer
+}
+
+func NewForwarder(next mailer.Forwarder, sealer *Sealer) *Forwarder {
+	return &Forwarder{next: next, sealer: sealer}
+}
+
+func (f *Forwarder) ForwardMail(ctx context.Context, msg *mailer.Message) error {
+	if msg.AuthenticationResults == "" {
+		return f.next.ForwardMail(ctx, msg)
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	seal, err := f.sealer.Seal(raw, msg.AuthenticationResults)
+	if err != nil {
+		logrus.Errorf("error sealing message to %v: %v", msg.To, err)
+		return f.next.ForwardMail(ctx, msg)
+	}
+	// The queue keeps the original, every attempt gets a fresh seal.
+	sealed := *msg
+	sealed.Raw = append(seal, raw...)
+	return f.next.ForwardMail(ctx, &sealed)
+}
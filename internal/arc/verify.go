@@ -0,0 +1,392 @@
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// RFC 8617 section 4.2.1: a chain longer than 50 sets is invalid.
+const maxInstances = 50
+
+var signatureValueRegex = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// Status is the chain validation status (RFC 8617 section 4.4).
+type Status string
+
+const (
+	StatusNone Status = "none"
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+)
+
+// Set is one validated ARC set.
+type Set struct {
+	Instance int
+	// Domain is the d= of the ARC-Seal, the intermediary that added the set.
+	Domain string
+	// AuthenticationResults is what the intermediary recorded, in Authentication-Results format without the instance tag.
+	AuthenticationResults string
+}
+
+// Verification is the result of validating the ARC chain of a message.
+type Verification struct {
+	Status Status
+	// Sets are the ARC sets from oldest to newest, only filled when the chain passed.
+	Sets []Set
+	Err  error
+}
+
+// TXTResolver looks up TXT records. *net.Resolver satisfies it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type Verifier struct {
+	Resolver TXTResolver
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{Resolver: net.DefaultResolver}
+}
+
+type arcSet struct {
+	aar, ams, seal string
+}
+
+// Verify validates the ARC chain of raw as described in RFC 8617 section 5.2.
+func (v *Verifier) Verify(ctx context.Context, raw []byte) *Verification {
+	fields, body := splitMessage(raw)
+	sets := make(map[int]*arcSet)
+	highest := 0
+	for _, f := range fields {
+		name := strings.ToLower(f.name)
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		instance, err := instanceOf(f.raw)
+		if err != nil || instance < 1 || instance > maxInstances {
+			return fail(fmt.Errorf("invalid instance in %v", f.name))
+		}
+		set, ok := sets[instance]
+		if !ok {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+		var target *string
+		switch name {
+		case "arc-seal":
+			target = &set.seal
+		case "arc-message-signature":
+			target = &set.ams
+		default:
+			target = &set.aar
+		}
+		if *target != "" {
+			return fail(fmt.Errorf("duplicate %v for instance %v", f.name, instance))
+		}
+		*target = f.raw
+		if instance > highest {
+			highest = instance
+		}
+	}
+	if highest == 0 {
+		return &Verification{Status: StatusNone}
+	}
+	for i := 1; i <= highest; i++ {
+		set, ok := sets[i]
+		if !ok || set.aar == "" || set.ams == "" || set.seal == "" {
+			return fail(fmt.Errorf("incomplete ARC set %v", i))
+		}
+		cv := parseTags(fieldValue(set.seal))["cv"]
+		if (i == 1 && cv != "none") || (i > 1 && cv != "pass") {
+			return fail(fmt.Errorf("ARC set %v has cv=%v", i, cv))
+		}
+	}
+
+	// Only the newest message signature has to hold, earlier ones were broken by the intermediaries on purpose.
+	if err := v.verifyMessageSignature(ctx, fields, body, sets[highest].ams); err != nil {
+		return fail(fmt.Errorf("ARC-Message-Signature: %w", err))
+	}
+	result := &Verification{Status: StatusPass}
+	for i := 1; i <= highest; i++ {
+		var input strings.Builder
+		for j := 1; j < i; j++ {
+			input.WriteString(relaxedHeader(sets[j].aar))
+			input.WriteString(relaxedHeader(sets[j].ams))
+			input.WriteString(relaxedHeader(sets[j].seal))
+		}
+		input.WriteString(relaxedHeader(sets[i].aar))
+		input.WriteString(relaxedHeader(sets[i].ams))
+		input.WriteString(strings.TrimSuffix(relaxedHeader(stripSignature(sets[i].seal)), "\r\n"))
+		tags := parseTags(fieldValue(sets[i].seal))
+		if err := v.verifySignature(ctx, tags, input.String()); err != nil {
+			return fail(fmt.Errorf("ARC-Seal %v: %w", i, err))
+		}
+		aar := fieldValue(sets[i].aar)
+		if _, rest, ok := strings.Cut(aar, ";"); ok {
+			aar = rest
+		}
+		result.Sets = append(result.Sets, Set{
+			Instance:              i,
+			Domain:                strings.ToLower(tags["d"]),
+			AuthenticationResults: strings.TrimSpace(aar),
+		})
+	}
+	return result
+}
+
+func fail(err error) *Verification {
+	return &Verification{Status: StatusFail, Err: err}
+}
+
+func instanceOf(raw string) (int, error) {
+	return strconv.Atoi(parseTags(fieldValue(raw))["i"])
+}
+
+// VerifyDKIM verifies the n-th DKIM-Signature field of raw, counting from zero. Unlike the dkim package it honours
+// the l= tag, so the caller decides what a signature over part of the body is worth. Every other requirement of
+// RFC 6376 section 6.1 that the dkim package enforces applies.
+func (v *Verifier) VerifyDKIM(ctx context.Context, raw []byte, n int) error {
+	fields, body := splitMessage(raw)
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if n == 0 {
+			if err := checkDKIMTags(parseTags(fieldValue(f.raw)), time.Now()); err != nil {
+				return err
+			}
+			return v.verifyMessageSignature(ctx, fields, body, f.raw)
+		}
+		n--
+	}
+	return errors.New("no such DKIM-Signature")
+}
+
+// checkDKIMTags validates the tags of a DKIM-Signature that do not depend on the key or the message.
+func checkDKIMTags(tags map[string]string, now time.Time) error {
+	if tags["v"] != "1" {
+		return errors.New("unsupported signature version")
+	}
+	domain := strings.ToLower(tags["d"])
+	if identifier, ok := tags["i"]; ok {
+		identifier = strings.ToLower(identifier)
+		if !strings.HasSuffix(identifier, "@"+domain) && !strings.HasSuffix(identifier, "."+domain) {
+			return errors.New("identity does not match the signing domain")
+		}
+	}
+	signed := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(strings.TrimSpace(name), "From") {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("From field not signed")
+	}
+	if expires, ok := tags["x"]; ok {
+		timestamp, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return errors.New("malformed expiration time")
+		}
+		if now.Unix() > timestamp {
+			return errors.New("signature has expired")
+		}
+	}
+	return nil
+}
+
+// verifyMessageSignature verifies an ARC-Message-Signature or DKIM-Signature field, which share their format.
+func (v *Verifier) verifyMessageSignature(ctx context.Context, fields []field, body []byte, signature string) error {
+	tags := parseTags(fieldValue(signature))
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	canonHeader := relaxedHeader
+	if headerCanon == "simple" {
+		canonHeader = func(raw string) string { return raw }
+	} else if headerCanon != "relaxed" {
+		return fmt.Errorf("unsupported header canonicalization %v", headerCanon)
+	}
+	var canonicalBody []byte
+	switch bodyCanon {
+	case "relaxed":
+		canonicalBody = relaxedBody(body)
+	case "simple":
+		canonicalBody = simpleBody(body)
+	default:
+		return fmt.Errorf("unsupported body canonicalization %v", bodyCanon)
+	}
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > len(canonicalBody) {
+			return errors.New("invalid body length")
+		}
+		canonicalBody = canonicalBody[:length]
+	}
+	bodyHash := sha256.Sum256(canonicalBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash does not match")
+	}
+
+	var input strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				input.WriteString(canonHeader(fields[i].raw))
+				break
+			}
+		}
+	}
+	input.WriteString(strings.TrimSuffix(canonHeader(stripSignature(signature)), "\r\n"))
+	return v.verifySignature(ctx, tags, input.String())
+}
+
+func (v *Verifier) verifySignature(ctx context.Context, tags map[string]string, input string) error {
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	key, keyTags, err := v.lookupKey(ctx, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	if err := checkKeyTags(keyTags, tags); err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(input))
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	case "ed25519-sha256":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key is not an Ed25519 key")
+		}
+		if !ed25519.Verify(pub, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %v", tags["a"])
+	}
+}
+
+// lookupKey fetches the public key published at selector._domainkey.domain, in the DKIM key record format, along
+// with the tags of the record. RSA keys below 1024 bits are refused (RFC 8301 section 3.2).
+func (v *Verifier) lookupKey(ctx context.Context, domain, selector string) (crypto.PublicKey, map[string]string, error) {
+	if domain == "" || selector == "" {
+		return nil, nil, errors.New("missing domain or selector")
+	}
+	records, err := v.Resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("no key record")
+	}
+	tags := parseTags(strings.Join(records, ""))
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(data) == 0 {
+		return nil, nil, errors.New("invalid or revoked key")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(data)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 1024 {
+			return nil, nil, fmt.Errorf("%v-bit RSA key is too weak", rsaKey.N.BitLen())
+		}
+		return key, tags, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(data), tags, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %v", tags["k"])
+	}
+}
+
+// checkKeyTags checks that a key record allows the signature made with it: its hash algorithms (h=), service types
+// (s=) and, for a DKIM identity, the t=s flag that forbids subdomains in i= (RFC 6376 section 3.6.1).
+func checkKeyTags(keyTags, tags map[string]string) error {
+	if hashes, ok := keyTags["h"]; ok && !containsTag(hashes, "sha256") {
+		return errors.New("inappropriate hash algorithm")
+	}
+	if services, ok := keyTags["s"]; ok && !containsTag(services, "email") && !containsTag(services, "*") {
+		return errors.New("inappropriate service")
+	}
+	// The i= of an ARC-Message-Signature is its instance, only a DKIM identity contains an @.
+	if _, identityDomain, ok := strings.Cut(tags["i"], "@"); ok && containsTag(keyTags["t"], "s") {
+		if !strings.EqualFold(identityDomain, tags["d"]) {
+			return errors.New("key does not allow subdomains in the identity")
+		}
+	}
+	return nil
+}
+
+// containsTag reports whether the colon-separated list contains value.
+func containsTag(list, value string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSignature empties the b= tag of a signature header field.
+func stripSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return name + ":" + signatureValueRegex.ReplaceAllString(value, "$1$2")
+}
+
+// simpleBody canonicalizes a message body with the simple algorithm of RFC 6376 section 3.4.3.
+func simpleBody(body []byte) []byte {
+	s := string(body)
+	for strings.HasSuffix(s, "\r\n") {
+		s = strings.TrimSuffix(s, "\r\n")
+	}
+	return []byte(s + "\r\n")
+}
+
+// Results parses the results recorded by the intermediary.
+func (s Set) Results() []authres.Result {
+	_, results, err := authres.Parse(s.AuthenticationResults)
+	if err != nil {
+		return nil
+	}
+	return results
+}
@@ -0,0 +1,113 @@
+package bounce_test
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/bounce"
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerp(t *testing.T) {
+	verp, err := bounce.NewVerp("0123456789abcdef", "bounce@bounce.maskr.app")
+	assert.NoError(t, err)
+	address := verp.Encode("Some+Tag@maskr.app", "abc123")
+	assert.True(t, strings.HasPrefix(address, "bounce+abc123+some+tag=maskr.app+"))
+	assert.True(t, verp.IsBounceAddress(address))
+
+	mask, id, err := verp.Decode(strings.ToUpper(address))
+	assert.NoError(t, err)
+	assert.Equal(t, "some+tag@maskr.app", mask)
+	assert.Equal(t, "abc123", id)
+
+	_, _, err = verp.Decode(strings.Replace(address, "abc123", "abc124", 1))
+	assert.ErrorIs(t, err, bounce.ErrInvalidSignature)
+	other, err := bounce.NewVerp("fedcba9876543210", "bounce@bounce.maskr.app")
+	assert.NoError(t, err)
+	_, _, err = other.Decode(address)
+	assert.ErrorIs(t, err, bounce.ErrInvalidSignature)
+	_, _, err = verp.Decode("bounce@bounce.maskr.app")
+	assert.ErrorIs(t, err, bounce.ErrNotVerp)
+
+	_, err = bounce.NewVerp("", "bounce@bounce.maskr.app")
+	assert.ErrorIs(t, err, bounce.ErrWeakSecret)
+	_, err = bounce.NewVerp("secret", "bounce@bounce.maskr.app")
+	assert.ErrorIs(t, err, bounce.ErrWeakSecret)
+}
+
+func parse(contentType, body string) (*bounce.Report, error) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	return bounce.Parse(header, strings.NewReader(strings.ReplaceAll(body, "\n", "\r\n")))
+}
+
+func TestParseDeliveryStatus(t *testing.T) {
+	report, err := parse(`multipart/report; report-type=delivery-status; boundary="b"`, `--b
+Content-Type: text/plain
+
+Delivery failed.
+--b
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+
+Final-Recipient: rfc822; other@example.com
+Action: delayed
+Status: 4.2.2
+
+Final-Recipient: rfc822; <user@example.com>
+Action: failed
+Status: 5.1.1 (user unknown)
+Diagnostic-Code: smtp; 550 5.1.1 No such user
+--b--
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", report.Recipient)
+	assert.Equal(t, "5.1.1", report.Status)
+	assert.Equal(t, "550 5.1.1 No such user", report.Diagnostic)
+	assert.True(t, report.Hard())
+	assert.False(t, report.Complaint())
+}
+
+func TestParseFeedbackReport(t *testing.T) {
+	report, err := parse(`multipart/report; report-type=feedback-report; boundary="b"`, `--b
+Content-Type: text/plain
+
+This is an abuse report.
+--b
+Content-Type: message/feedback-report
+
+Feedback-Type: abuse
+User-Agent: SomeGenerator/1.0
+Version: 1
+Original-Rcpt-To: <user@example.com>
+--b--
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "abuse", report.FeedbackType)
+	assert.Equal(t, "user@example.com", report.Recipient)
+	assert.True(t, report.Complaint())
+	assert.False(t, report.Hard())
+}
+
+func TestParseNotBounce(t *testing.T) {
+	_, err := parse("text/plain", "I am on vacation.")
+	assert.ErrorIs(t, err, bounce.ErrNotBounce)
+}
+
+func TestTracker(t *testing.T) {
+	tracker := bounce.NewTracker(store.NewMemoryStore())
+	count, err := tracker.RecordHard("mask@maskr.app", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, _ = tracker.RecordHard("mask@maskr.app", "1")
+	assert.Equal(t, 1, count, "the same message is only counted once")
+	count, _ = tracker.RecordHard("MASK@maskr.app", "2")
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, tracker.Reset("mask@maskr.app"))
+	count, _ = tracker.RecordHard("mask@maskr.app", "3")
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,162 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+var ErrNotBounce = errors.New("message is not a delivery status notification or feedback report")
+
+var statusRegex = regexp.MustCompile(`\b([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// Report is what a bounce tells about a single message.
+type Report struct {
+	// Recipient is the recipient the report is about, if the reporting MTA named it.
+	Recipient string
+	// Action is the RFC 3464 action: failed, delayed, delivered, relayed or expanded.
+	Action string
+	// Status is the RFC 3463 status code, e.g. 5.1.1.
+	Status     string
+	Diagnostic string
+	// FeedbackType is set for RFC 5965 feedback reports, e.g. abuse when the recipient marked the message as spam.
+	FeedbackType string
+}
+
+// Hard reports whether the destination permanently refused the message.
+func (r *Report) Hard() bool {
+	return r.FeedbackType == "" && r.Action == "failed" && strings.HasPrefix(r.Status, "5.")
+}
+
+// Complaint reports whether the report is a feedback report rather than a delivery failure.
+func (r *Report) Complaint() bool {
+	return r.FeedbackType != ""
+}
+
+// Parse reads a multipart/report message, either a delivery status notification (RFC 3464)
+// or an abuse feedback report (RFC 5965).
+func Parse(header textproto.MIMEHeader, body io.Reader) (*Report, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, ErrNotBounce
+	}
+	return parseMultipart(multipart.NewReader(body, params["boundary"]), 0)
+}
+
+func parseMultipart(reader *multipart.Reader, depth int) (*Report, error) {
+	if depth > 8 {
+		return nil, ErrNotBounce
+	}
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return nil, ErrNotBounce
+		}
+		if err != nil {
+			return nil, err
+		}
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "message/delivery-status", mediaType == "message/global-delivery-status":
+			return parseDeliveryStatus(part)
+		case mediaType == "message/feedback-report":
+			return parseFeedbackReport(part)
+		case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+			report, err := parseMultipart(multipart.NewReader(part, params["boundary"]), depth+1)
+			if err != ErrNotBounce {
+				return report, err
+			}
+		}
+	}
+}
+
+// parseDeliveryStatus returns the first failed recipient of a message/delivery-status part, or the first recipient if none failed.
+func parseDeliveryStatus(r io.Reader) (*Report, error) {
+	groups, err := readFieldGroups(r)
+	if err != nil {
+		return nil, err
+	}
+	// The first group holds the per-message fields.
+	if len(groups) < 2 {
+		return nil, ErrNotBounce
+	}
+	var report *Report
+	for _, fields := range groups[1:] {
+		current := &Report{
+			Recipient:  addressOf(fields.Get("Final-Recipient")),
+			Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:     statusRegex.FindString(fields.Get("Status")),
+			Diagnostic: typeValue(fields.Get("Diagnostic-Code")),
+		}
+		if current.Recipient == "" {
+			current.Recipient = addressOf(fields.Get("Original-Recipient"))
+		}
+		if report == nil || (report.Action != "failed" && current.Action == "failed") {
+			report = current
+		}
+	}
+	return report, nil
+}
+
+func parseFeedbackReport(r io.Reader) (*Report, error) {
+	groups, err := readFieldGroups(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, ErrNotBounce
+	}
+	fields := groups[0]
+	report := &Report{
+		Recipient:    addressOf(fields.Get("Original-Rcpt-To")),
+		FeedbackType: strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type"))),
+	}
+	if report.FeedbackType == "" {
+		return nil, ErrNotBounce
+	}
+	return report, nil
+}
+
+// readFieldGroups reads header-like field groups separated by blank lines.
+func readFieldGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	var groups []textproto.MIMEHeader
+	for _, chunk := range bytes.Split(data, []byte("\n\n")) {
+		chunk = bytes.TrimSpace(chunk)
+		if len(chunk) == 0 {
+			continue
+		}
+		reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(chunk, '\n', '\n'))))
+		fields, err := reader.ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			continue
+		}
+		groups = append(groups, fields)
+	}
+	return groups, nil
+}
+
+// typeValue strips the type prefix of fields like "rfc822; user@example.com".
+func typeValue(field string) string {
+	if i := strings.Index(field, ";"); i != -1 {
+		field = field[i+1:]
+	}
+	return strings.TrimSpace(field)
+}
+
+func addressOf(field string) string {
+	return strings.Trim(typeValue(field), "<>")
+}
@@ -0,0 +1,79 @@
+package bounce
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/maskrapp/relay/internal/store"
+)
+
+const keyPrefix = "bounce/"
+
+type record struct {
+	HardBounces int
+	LastMessage string
+}
+
+// Tracker counts consecutive hard bounces of the destination behind each mask.
+// A successful delivery resets the count, so only destinations that keep refusing mail add up.
+type Tracker struct {
+	store store.Store
+	mutex sync.Mutex
+}
+
+func NewTracker(s store.Store) *Tracker {
+	return &Tracker{store: s}
+}
+
+// RecordHard records a hard bounce of messageId and returns the number of consecutive hard bounces for mask.
+// Repeated bounces of the same message are only counted once.
+func (t *Tracker) RecordHard(mask, messageId string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	rec, err := t.load(mask)
+	if err != nil {
+		return 0, err
+	}
+	if rec.LastMessage == messageId {
+		return rec.HardBounces, nil
+	}
+	rec.HardBounces++
+	rec.LastMessage = messageId
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	return rec.HardBounces, t.store.Put(keyPrefix+strings.ToLower(mask), data)
+}
+
+// Reset clears the count for mask after a successful delivery.
+func (t *Tracker) Reset(mask string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.store.Delete(keyPrefix + strings.ToLower(mask))
+}
+
+func (t *Tracker) load(mask string) (*record, error) {
+	rec := &record{}
+	data, err := t.store.Get(keyPrefix + strings.ToLower(mask))
+	if errors.Is(err, store.ErrNotFound) {
+		return rec, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, json.Unmarshal(data, rec)
+}
+
+// NewMessageId returns a short random ID to tell the messages of a mask apart in VERP addresses.
+func NewMessageId() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,96 @@
+package bounce
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Variable envelope return paths: every forwarded message gets its own bounce address, so a bounce
+// identifies the mask and message it belongs to without having to trust its content.
+// The address has the form <prefix>+<message id>+<mask local part>=<mask domain>+<signature>@<domain>.
+
+// MinSecretLength is the shortest secret NewVerp accepts, anyone who guesses the secret can forge bounces.
+const MinSecretLength = 16
+
+var (
+	ErrNotVerp          = errors.New("address is not a VERP address")
+	ErrInvalidSignature = errors.New("VERP signature does not match")
+	ErrWeakSecret       = fmt.Errorf("VERP secret must be at least %v characters", MinSecretLength)
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Verp struct {
+	secret []byte
+	prefix string
+	domain string
+}
+
+// NewVerp derives VERP addresses from bounceAddress, e.g. bounce@bounce.maskr.app.
+func NewVerp(secret, bounceAddress string) (*Verp, error) {
+	if len(secret) < MinSecretLength {
+		return nil, ErrWeakSecret
+	}
+	prefix, domain := bounceAddress, ""
+	if i := strings.LastIndex(bounceAddress, "@"); i != -1 {
+		prefix, domain = bounceAddress[:i], bounceAddress[i+1:]
+	}
+	return &Verp{
+		secret: []byte(secret),
+		prefix: strings.ToLower(prefix),
+		domain: strings.ToLower(domain),
+	}, nil
+}
+
+func (v *Verp) Encode(mask, messageId string) string {
+	i := strings.LastIndex(mask, "@")
+	if i == -1 {
+		return v.prefix + "@" + v.domain
+	}
+	local, domain := strings.ToLower(mask[:i]), strings.ToLower(mask[i+1:])
+	return fmt.Sprintf("%v+%v+%v=%v+%v@%v", v.prefix, messageId, local, domain, v.sign(messageId, local, domain), v.domain)
+}
+
+// Decode returns the mask and message ID encoded in address.
+func (v *Verp) Decode(address string) (string, string, error) {
+	i := strings.LastIndex(address, "@")
+	if i == -1 || !strings.EqualFold(address[i+1:], v.domain) {
+		return "", "", ErrNotVerp
+	}
+	// The local part of the mask may contain '+' itself.
+	parts := strings.SplitN(strings.ToLower(address[:i]), "+", 3)
+	if len(parts) != 3 || parts[0] != v.prefix {
+		return "", "", ErrNotVerp
+	}
+	messageId, rest := parts[1], parts[2]
+	k := strings.LastIndex(rest, "+")
+	if k == -1 {
+		return "", "", ErrNotVerp
+	}
+	encodedMask, signature := rest[:k], rest[k+1:]
+	j := strings.LastIndex(encodedMask, "=")
+	if j == -1 {
+		return "", "", ErrNotVerp
+	}
+	local, domain := encodedMask[:j], encodedMask[j+1:]
+	if !hmac.Equal([]byte(signature), []byte(v.sign(messageId, local, domain))) {
+		return "", "", ErrInvalidSignature
+	}
+	return local + "@" + domain, messageId, nil
+}
+
+// IsBounceAddress reports whether address is on the bounce domain.
+func (v *Verp) IsBounceAddress(address string) bool {
+	i := strings.LastIndex(address, "@")
+	return i != -1 && strings.EqualFold(address[i+1:], v.domain)
+}
+
+func (v *Verp) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return strings.ToLower(encoding.EncodeToString(mac.Sum(nil))[:10])
+}
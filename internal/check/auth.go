@@ -0,0 +1,212 @@
+package check
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// Part names a part of AuthResults. Checks declare the parts they provide and the parts they require.
+type Part string
+
+const (
+	PartSPF   Part = "spf"
+	PartDKIM  Part = "dkim"
+	PartARC   Part = "arc"
+	PartDMARC Part = "dmarc"
+	PartIPRev Part = "iprev"
+)
+
+// AuthResults is what the checks found out about the authenticity of a message. Each check fills in its own part,
+// the parts of other checks are nil.
+type AuthResults struct {
+	SPF   *SPFResult
+	DKIM  *DKIMResult
+	ARC   *ARCResult
+	DMARC *DMARCResult
+	IPRev *IPRevResult
+}
+
+type SPFResult struct {
+	Value authres.ResultValue
+	// MailFrom is empty for the null sender, SPF then checked the HELO identity.
+	MailFrom string
+	Helo     string
+	IP       net.IP
+	// Err explains a permerror or temperror.
+	Err error
+}
+
+// Domain is the domain SPF authenticated: the domain of the envelope sender, or the HELO name for the null sender.
+func (r *SPFResult) Domain() string {
+	if _, domain, ok := strings.Cut(r.MailFrom, "@"); ok {
+		return domain
+	}
+	return r.Helo
+}
+
+// ReceivedSPF formats the result as the value of a Received-SPF header added by receiver (RFC 7208 section 9.1).
+func (r *SPFResult) ReceivedSPF(receiver string) string {
+	identity, sender := "mailfrom", r.MailFrom
+	if sender == "" {
+		identity, sender = "helo", "postmaster@"+r.Helo
+	}
+	var comment string
+	switch r.Value {
+	case authres.ResultPass:
+		comment = fmt.Sprintf("domain of %v designates %v as permitted sender", sender, r.IP)
+	case authres.ResultFail, authres.ResultSoftFail:
+		comment = fmt.Sprintf("domain of %v does not designate %v as permitted sender", sender, r.IP)
+	case authres.ResultNeutral:
+		comment = fmt.Sprintf("%v is neither permitted nor denied by domain of %v", r.IP, sender)
+	case authres.ResultNone:
+		comment = fmt.Sprintf("domain of %v does not publish SPF", sender)
+	default:
+		comment = fmt.Sprintf("error evaluating SPF for %v", sender)
+	}
+	value := fmt.Sprintf("%v (%v: %v) client-ip=%v; envelope-from=%q; helo=%v; receiver=%v; identity=%v",
+		r.Value, receiver, comment, r.IP, r.MailFrom, r.Helo, receiver, identity)
+	if r.Err != nil {
+		value += fmt.Sprintf("; problem=%q", r.Err.Error())
+	}
+	return value
+}
+
+type DKIMSignature struct {
+	Value      authres.ResultValue
+	Domain     string
+	Selector   string
+	Identifier string
+	// Algorithm is the a= tag, e.g. rsa-sha256.
+	Algorithm string
+	// KeyBits is the size of the public key, zero when it could not be retrieved.
+	KeyBits int
+	// BodyLength is the l= tag, content appended after that many bytes of the body is not covered by the signature.
+	BodyLength *int64
+	// ThirdParty is set when the signing domain is not aligned with the header From domain.
+	ThirdParty bool
+	// Reason explains a policy result, a signature that verified but is not accepted.
+	Reason string
+	// Err is why the signature did not pass.
+	Err error
+}
+
+type DKIMResult struct {
+	// Signatures are in the order of the DKIM-Signature fields of the message.
+	Signatures []DKIMSignature
+	// Err is set when the message could not be verified at all.
+	Err error
+}
+
+// Passing returns the signatures that verified.
+func (r *DKIMResult) Passing() []DKIMSignature {
+	var passing []DKIMSignature
+	for _, v := range r.Signatures {
+		if v.Value == authres.ResultPass {
+			passing = append(passing, v)
+		}
+	}
+	return passing
+}
+
+type ARCResult struct {
+	Value authres.ResultValue
+	// Sealer is the domain of the newest ARC set.
+	Sealer string
+	// Override is set when a trusted sealer saw DMARC pass for the domain of the message.
+	Override bool
+}
+
+type DMARCResult struct {
+	Value authres.ResultValue
+	// From is the domain of the header From field.
+	From string
+	// Record is the DMARC record published for From, or for its organizational domain at PolicyDomain.
+	Record       *dmarc.Record
+	PolicyDomain string
+	// Policy is the policy that applies to From, sp= for a subdomain that has no record of its own.
+	Policy dmarc.Policy
+	// SPFAligned and DKIMAligned are set when a passing identifier is aligned with From.
+	SPFAligned  bool
+	DKIMAligned bool
+	// Reason is the policy override (RFC 7489 section 6.7), if any.
+	Reason string
+}
+
+type IPRevResult struct {
+	Value authres.ResultValue
+	IP    net.IP
+	PTR   string
+}
+
+// Merge copies the parts set in other.
+func (a *AuthResults) Merge(other AuthResults) {
+	if other.SPF != nil {
+		a.SPF = other.SPF
+	}
+	if other.DKIM != nil {
+		a.DKIM = other.DKIM
+	}
+	if other.ARC != nil {
+		a.ARC = other.ARC
+	}
+	if other.DMARC != nil {
+		a.DMARC = other.DMARC
+	}
+	if other.IPRev != nil {
+		a.IPRev = other.IPRev
+	}
+}
+
+// only returns the given parts of a.
+func (a AuthResults) only(parts []Part) AuthResults {
+	var result AuthResults
+	for _, v := range parts {
+		switch v {
+		case PartSPF:
+			result.SPF = a.SPF
+		case PartDKIM:
+			result.DKIM = a.DKIM
+		case PartARC:
+			result.ARC = a.ARC
+		case PartDMARC:
+			result.DMARC = a.DMARC
+		case PartIPRev:
+			result.IPRev = a.IPRev
+		}
+	}
+	return result
+}
+
+// Results returns the parts as authentication results for an Authentication-Results header (RFC 8601).
+func (a AuthResults) Results() []authres.Result {
+	var results []authres.Result
+	if a.SPF != nil {
+		results = append(results, &authres.SPFResult{Value: a.SPF.Value, From: a.SPF.MailFrom, Helo: a.SPF.Helo})
+	}
+	if a.DKIM != nil {
+		if len(a.DKIM.Signatures) == 0 {
+			value := authres.ResultNone
+			if a.DKIM.Err != nil {
+				value = authres.ResultPermError
+			}
+			results = append(results, &authres.DKIMResult{Value: value})
+		}
+		for _, v := range a.DKIM.Signatures {
+			results = append(results, &authres.DKIMResult{Value: v.Value, Reason: v.Reason, Domain: v.Domain, Identifier: v.Identifier})
+		}
+	}
+	if a.DMARC != nil {
+		results = append(results, &authres.DMARCResult{Value: a.DMARC.Value, Reason: a.DMARC.Reason, From: a.DMARC.From})
+	}
+	if a.ARC != nil {
+		results = append(results, &authres.GenericResult{Method: "arc", Value: a.ARC.Value, Params: map[string]string{}})
+	}
+	if a.IPRev != nil {
+		results = append(results, &authres.IPRevResult{Value: a.IPRev.Value, IP: a.IPRev.IP.String()})
+	}
+	return results
+}
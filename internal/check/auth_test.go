@@ -0,0 +1,56 @@
+package check_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/stretchr/testify/assert"
+)
+
+// The expected values are what authres.Format writes: properties in alphabetical order, a space after a result without
+// properties and quotes around values that are not tokens, all of which RFC 8601 allows.
+func TestAuthenticationResultsHeader(t *testing.T) {
+	tests := map[string]struct {
+		auth     check.AuthResults
+		expected string
+	}{
+		"nothing checked": {check.AuthResults{}, "mx.maskr.app; none"},
+		"all parts": {
+			check.AuthResults{
+				SPF: &check.SPFResult{Value: authres.ResultPass, MailFrom: "bounces@example.com", Helo: "mail.example.com"},
+				DKIM: &check.DKIMResult{Signatures: []check.DKIMSignature{
+					{Value: authres.ResultPass, Domain: "example.com", Identifier: "@example.com"},
+					{Value: authres.ResultFail, Reason: "bad signature", Domain: "esp.example"},
+				}},
+				DMARC: &check.DMARCResult{Value: authres.ResultPass, From: "example.com"},
+				ARC:   &check.ARCResult{Value: authres.ResultNone},
+				IPRev: &check.IPRevResult{Value: authres.ResultPass, IP: net.ParseIP("192.0.2.1"), PTR: "mail.example.com"},
+			},
+			"mx.maskr.app;" +
+				" spf=pass smtp.helo=mail.example.com smtp.mailfrom=bounces@example.com;" +
+				" dkim=pass header.d=example.com header.i=@example.com;" +
+				" dkim=fail reason=\"bad signature\" header.d=esp.example;" +
+				" dmarc=pass header.from=example.com;" +
+				" arc=none ;" +
+				" iprev=pass policy.iprev=192.0.2.1",
+		},
+		"unsigned": {
+			check.AuthResults{DKIM: &check.DKIMResult{}},
+			"mx.maskr.app; dkim=none ",
+		},
+		"unparsable signature": {
+			check.AuthResults{DKIM: &check.DKIMResult{Err: errors.New("malformed DKIM-Signature")}},
+			"mx.maskr.app; dkim=permerror ",
+		},
+		"reverse lookup failed": {
+			check.AuthResults{IPRev: &check.IPRevResult{Value: authres.ResultTempError, IP: net.ParseIP("2001:db8::1")}},
+			`mx.maskr.app; iprev=temperror policy.iprev="2001:db8::1"`,
+		},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.expected, authres.Format("mx.maskr.app", test.auth.Results()), name)
+	}
+}
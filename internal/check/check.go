@@ -5,12 +5,20 @@ import (
 	"net"
 )
 
+// Symbol is a finding of a check. The policy weighs the scores of all symbols to decide what happens to a message.
+type Symbol struct {
+	Name  string
+	Score float64
+	// Tempfail defers the message when the check could not come to a conclusion, e.g. because DNS failed.
+	Tempfail bool
+}
+
 type CheckResult struct {
-	Message    string
-	Success    bool
-	Reject     bool
-	Quarantine bool
-	Data       map[string]any
+	Message string
+	Success bool
+	Symbols []Symbol
+	// Auth holds the part of the authentication results the check provides, if any.
+	Auth AuthResults
 }
 
 type CheckValues struct {
@@ -20,9 +28,21 @@ type CheckValues struct {
 	MailData     string
 	RemoteHost   string
 	Ip           net.IP
+	// Auth holds the parts of the authentication results the check requires.
+	Auth AuthResults
 }
 
 type Check interface {
 	Name() string
 	Validate(context.Context, CheckValues) CheckResult
 }
+
+// Producer is implemented by checks that fill in parts of the authentication results.
+type Producer interface {
+	Provides() []Part
+}
+
+// Dependent is implemented by checks that need the results of other checks, they run after the checks providing them.
+type Dependent interface {
+	Requires() []Part
+}
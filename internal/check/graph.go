@@ -0,0 +1,155 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Graph runs checks in the order their dependencies dictate, independent checks run in parallel.
+type Graph struct {
+	checks []Check
+	// deps holds the indexes of the checks each check depends on.
+	deps [][]int
+}
+
+// Outcome is the result of a single check in a run of the graph.
+type Outcome struct {
+	Name     string
+	Result   CheckResult
+	Duration time.Duration
+}
+
+// NewGraph resolves the dependencies of checks. Every required part needs exactly one provider and the checks
+// may not depend on each other in a cycle.
+func NewGraph(checks ...Check) (*Graph, error) {
+	providers := make(map[Part]int)
+	for i, c := range checks {
+		producer, ok := c.(Producer)
+		if !ok {
+			continue
+		}
+		for _, key := range producer.Provides() {
+			if other, ok := providers[key]; ok {
+				return nil, fmt.Errorf("%v is provided by both %v and %v", key, checks[other].Name(), c.Name())
+			}
+			providers[key] = i
+		}
+	}
+	deps := make([][]int, len(checks))
+	for i, c := range checks {
+		dependent, ok := c.(Dependent)
+		if !ok {
+			continue
+		}
+		seen := make(map[int]bool)
+		for _, key := range dependent.Requires() {
+			provider, ok := providers[key]
+			if !ok {
+				return nil, fmt.Errorf("%v requires %v, which no check provides", c.Name(), key)
+			}
+			if provider == i {
+				return nil, fmt.Errorf("%v requires %v, which it provides itself", c.Name(), key)
+			}
+			if !seen[provider] {
+				seen[provider] = true
+				deps[i] = append(deps[i], provider)
+			}
+		}
+	}
+	g := &Graph{checks: checks, deps: deps}
+	if cycle := g.cycle(); cycle != nil {
+		return nil, fmt.Errorf("checks depend on each other: %v", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// cycle returns the names of the checks in a dependency cycle, if there is one.
+func (g *Graph) cycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.checks))
+	var path []int
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			var names []string
+			for j := len(path) - 1; j >= 0; j-- {
+				names = append([]string{g.checks[path[j]].Name()}, names...)
+				if path[j] == i {
+					break
+				}
+			}
+			return append(names, g.checks[i].Name())
+		}
+		state[i] = visiting
+		path = append(path, i)
+		for _, dep := range g.deps[i] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range g.checks {
+		if cycle := visit(i); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Run runs every check once, each as soon as the checks it depends on finished. The outcomes are in the order
+// the checks were passed to NewGraph.
+func (g *Graph) Run(ctx context.Context, values CheckValues) []Outcome {
+	outcomes := make([]Outcome, len(g.checks))
+	done := make([]chan struct{}, len(g.checks))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	for i := range g.checks {
+		go func(i int) {
+			defer close(done[i])
+			c := g.checks[i]
+			// A dependency always finishes, on a cancelled context it returns early by itself.
+			for _, dep := range g.deps[i] {
+				<-done[dep]
+			}
+			checkValues := values
+			checkValues.Auth = g.state(i, outcomes)
+			logrus.Debugf("running check %v", c.Name())
+			start := time.Now()
+			result := c.Validate(ctx, checkValues)
+			outcomes[i] = Outcome{Name: c.Name(), Result: result, Duration: time.Since(start)}
+			logrus.Infof("finished check %v in %vms", c.Name(), outcomes[i].Duration.Milliseconds())
+		}(i)
+	}
+	for _, ch := range done {
+		<-ch
+	}
+	return outcomes
+}
+
+// state collects the results check i requires from the outcomes of its dependencies, which have all finished.
+func (g *Graph) state(i int, outcomes []Outcome) AuthResults {
+	dependent, ok := g.checks[i].(Dependent)
+	if !ok {
+		return AuthResults{}
+	}
+	var state AuthResults
+	for _, dep := range g.deps[i] {
+		state.Merge(outcomes[dep].Result.Auth)
+	}
+	return state.only(dependent.Requires())
+}
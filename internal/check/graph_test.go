@@ -0,0 +1,73 @@
+package check_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCheck struct {
+	name     string
+	provides []check.Part
+	requires []check.Part
+	validate func(values check.CheckValues) check.CheckResult
+}
+
+func (c fakeCheck) Name() string           { return c.name }
+func (c fakeCheck) Provides() []check.Part { return c.provides }
+func (c fakeCheck) Requires() []check.Part { return c.requires }
+
+func (c fakeCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
+	return c.validate(values)
+}
+
+func provider(name string, part check.Part, auth check.AuthResults, delay time.Duration) fakeCheck {
+	return fakeCheck{name: name, provides: []check.Part{part}, validate: func(check.CheckValues) check.CheckResult {
+		time.Sleep(delay)
+		return check.CheckResult{Auth: auth}
+	}}
+}
+
+func TestGraphOrder(t *testing.T) {
+	var running int32
+	spf := check.AuthResults{SPF: &check.SPFResult{Value: authres.ResultPass}}
+	dkim := check.AuthResults{DKIM: &check.DKIMResult{Signatures: []check.DKIMSignature{{Value: authres.ResultPass, Domain: "example.com"}}}}
+	iprev := check.AuthResults{IPRev: &check.IPRevResult{Value: authres.ResultPass}}
+	parallel := fakeCheck{name: "parallel", validate: func(check.CheckValues) check.CheckResult {
+		atomic.AddInt32(&running, 1)
+		return check.CheckResult{}
+	}}
+	dependent := fakeCheck{name: "dependent", requires: []check.Part{check.PartSPF, check.PartDKIM}, validate: func(values check.CheckValues) check.CheckResult {
+		auth := values.Auth
+		return check.CheckResult{Success: auth.SPF != nil && len(auth.DKIM.Passing()) == 1 && auth.IPRev == nil}
+	}}
+	// Registered before its dependencies on purpose.
+	graph, err := check.NewGraph(dependent, provider("slow", check.PartSPF, spf, 50*time.Millisecond),
+		provider("fast", check.PartDKIM, dkim, 0), provider("iprev", check.PartIPRev, iprev, 0), parallel)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	outcomes := graph.Run(context.Background(), check.CheckValues{})
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "independent checks run in parallel")
+	assert.Equal(t, "dependent", outcomes[0].Name)
+	assert.True(t, outcomes[0].Result.Success, "the dependent check sees exactly the parts it requires")
+	assert.Equal(t, int32(1), running)
+}
+
+func TestGraphErrors(t *testing.T) {
+	_, err := check.NewGraph(fakeCheck{name: "orphan", requires: []check.Part{check.PartDMARC}})
+	assert.Error(t, err)
+
+	_, err = check.NewGraph(provider("one", check.PartSPF, check.AuthResults{}, 0), provider("two", check.PartSPF, check.AuthResults{}, 0))
+	assert.Error(t, err)
+
+	a := fakeCheck{name: "a", provides: []check.Part{check.PartSPF}, requires: []check.Part{check.PartDKIM}}
+	b := fakeCheck{name: "b", provides: []check.Part{check.PartDKIM}, requires: []check.Part{check.PartSPF}}
+	_, err = check.NewGraph(a, b)
+	assert.ErrorContains(t, err, "a -> b -> a")
+}
@@ -2,6 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -19,6 +22,88 @@ type Config struct {
 	ZeptoMail struct {
 		EmailToken string
 	}
+	Mailer struct {
+		Backend           string
+		BounceAddress     string
+		DaemonAddress     string
+		FilePath          string
+		MaxMessageSize    int
+		MaxAttachmentSize int
+	}
+	SMTPRelay struct {
+		Address  string
+		Username string
+		Password string
+	}
+	Queue struct {
+		Workers    int
+		Lifetime   time.Duration
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+	}
+	SRS struct {
+		Secret string
+		Domain string
+	}
+	Bounce struct {
+		Secret           string
+		DisableThreshold int
+	}
+	Policy struct {
+		TagScore        float64
+		QuarantineScore float64
+		TempfailScore   float64
+		RejectScore     float64
+		// Weights multiply the scores of a check, by check name.
+		Weights map[string]float64
+	}
+	DKIM struct {
+		MinRSABits int
+		// WeakKeys and BodyLength are allow, penalize or fail.
+		WeakKeys   string
+		BodyLength string
+	}
+	DMARCReports struct {
+		// Address sends the reports, reporting is disabled when it is empty.
+		Address  string
+		OrgName  string
+		Interval time.Duration
+		// Failures enables failure reports, RedactFields and RedactRecipients decide what of the original header they carry.
+		Failures         bool
+		RedactFields     []string
+		RedactRecipients bool
+		// FailureDomainLimit and FailureAddressLimit are the failure reports per policy domain and per ruf= address
+		// in every FailureLimitInterval. FailureQueue failures at most wait to be reported.
+		FailureDomainLimit   int
+		FailureAddressLimit  int
+		FailureLimitInterval time.Duration
+		FailureQueue         int
+	}
+	DNS struct {
+		// Servers answer the lookups of the checks, the system resolver does when empty. DNSBLServers answer the
+		// DNSBL queries, Servers do when empty.
+		Servers      []string
+		DNSBLServers []string
+		// Timeout limits every query to one server, before the next one is tried.
+		Timeout time.Duration
+		// CacheSize is the number of answers the cache holds, the cache is disabled when it is 0.
+		CacheSize int
+		// CacheTTL and CacheNegativeTTL apply when the resolver does not report TTLs, CacheMaxTTL caps every TTL.
+		CacheTTL         time.Duration
+		CacheNegativeTTL time.Duration
+		CacheMaxTTL      time.Duration
+		StatsInterval    time.Duration
+	}
+	Loop struct {
+		MaxReceived int
+		MaxPasses   int
+	}
+	ARC struct {
+		Domain         string
+		Selector       string
+		PrivateKey     string
+		TrustedSealers []string
+	}
 	TLS struct {
 		PrivateKeyPath  string
 		CertificatePath string
@@ -29,9 +114,11 @@ type Config struct {
 	GRPC struct {
 		MainAPIHost string
 	}
-	Production    bool
-	SpamhausToken string
-	Hostname      string
+	Production         bool
+	SpamhausToken      string
+	Hostname           string
+	DataDir            string
+	ReverseAliasDomain string
 }
 
 func New() *Config {
@@ -46,6 +133,66 @@ func New() *Config {
 
 	cfg.ZeptoMail.EmailToken = os.Getenv("MAIL_TOKEN")
 
+	cfg.Mailer.Backend = getOrDefault("MAILER_BACKEND", "zeptomail")
+	cfg.Mailer.BounceAddress = getOrDefault("BOUNCE_ADDRESS", "bounce@bounce.maskr.app")
+	cfg.Mailer.DaemonAddress = getOrDefault("MAILER_DAEMON_ADDRESS", "mailer-daemon@maskr.app")
+	cfg.Mailer.FilePath = os.Getenv("MAILER_FILE")
+	cfg.Mailer.MaxMessageSize = getIntOrDefault("MAX_MESSAGE_SIZE", 25*1024*1024)
+	cfg.Mailer.MaxAttachmentSize = getIntOrDefault("MAX_ATTACHMENT_SIZE", 15*1024*1024)
+
+	cfg.SMTPRelay.Address = os.Getenv("SMTP_RELAY_ADDRESS")
+	cfg.SMTPRelay.Username = os.Getenv("SMTP_RELAY_USERNAME")
+	cfg.SMTPRelay.Password = os.Getenv("SMTP_RELAY_PASSWORD")
+
+	cfg.Queue.Workers = getIntOrDefault("QUEUE_WORKERS", 4)
+	cfg.Queue.Lifetime = getDurationOrDefault("QUEUE_LIFETIME", 5*24*time.Hour)
+	cfg.Queue.MinBackoff = getDurationOrDefault("QUEUE_MIN_BACKOFF", time.Minute)
+	cfg.Queue.MaxBackoff = getDurationOrDefault("QUEUE_MAX_BACKOFF", time.Hour)
+
+	cfg.SRS.Secret = os.Getenv("SRS_SECRET")
+	cfg.SRS.Domain = getOrDefault("SRS_DOMAIN", "srs.maskr.app")
+
+	cfg.Bounce.Secret = os.Getenv("BOUNCE_SECRET")
+	cfg.Bounce.DisableThreshold = getIntOrDefault("BOUNCE_DISABLE_THRESHOLD", 3)
+
+	cfg.Policy.TagScore = getFloatOrDefault("POLICY_TAG_SCORE", 4)
+	cfg.Policy.QuarantineScore = getFloatOrDefault("POLICY_QUARANTINE_SCORE", 6)
+	cfg.Policy.TempfailScore = getFloatOrDefault("POLICY_TEMPFAIL_SCORE", 12)
+	cfg.Policy.RejectScore = getFloatOrDefault("POLICY_REJECT_SCORE", 15)
+	cfg.Policy.Weights = getWeightsOrDefault("POLICY_WEIGHTS", map[string]float64{})
+
+	cfg.DKIM.MinRSABits = getIntOrDefault("DKIM_MIN_RSA_BITS", 2048)
+	cfg.DKIM.WeakKeys = getOrDefault("DKIM_WEAK_KEY_POLICY", "penalize")
+	cfg.DKIM.BodyLength = getOrDefault("DKIM_BODY_LENGTH_POLICY", "penalize")
+
+	cfg.DMARCReports.Address = os.Getenv("DMARC_REPORT_ADDRESS")
+	cfg.DMARCReports.OrgName = getOrDefault("DMARC_REPORT_ORG", "maskr.app")
+	cfg.DMARCReports.Interval = getDurationOrDefault("DMARC_REPORT_INTERVAL", 24*time.Hour)
+	cfg.DMARCReports.Failures = getOrDefault("DMARC_FAILURE_REPORTS", "false") == "true"
+	cfg.DMARCReports.RedactFields = getListOrDefault("DMARC_FAILURE_REDACT_FIELDS", []string{"To", "Cc", "Bcc", "Delivered-To", "X-Original-To"})
+	cfg.DMARCReports.RedactRecipients = getOrDefault("DMARC_FAILURE_REDACT_RECIPIENTS", "true") == "true"
+	cfg.DMARCReports.FailureDomainLimit = getIntOrDefault("DMARC_FAILURE_DOMAIN_LIMIT", 10)
+	cfg.DMARCReports.FailureAddressLimit = getIntOrDefault("DMARC_FAILURE_ADDRESS_LIMIT", 20)
+	cfg.DMARCReports.FailureLimitInterval = getDurationOrDefault("DMARC_FAILURE_LIMIT_INTERVAL", time.Hour)
+	cfg.DMARCReports.FailureQueue = getIntOrDefault("DMARC_FAILURE_QUEUE", 100)
+
+	cfg.DNS.Servers = getListOrDefault("DNS_SERVERS", nil)
+	cfg.DNS.DNSBLServers = getListOrDefault("DNS_DNSBL_SERVERS", nil)
+	cfg.DNS.Timeout = getDurationOrDefault("DNS_TIMEOUT", 3*time.Second)
+	cfg.DNS.CacheSize = getIntOrDefault("DNS_CACHE_SIZE", 10000)
+	cfg.DNS.CacheTTL = getDurationOrDefault("DNS_CACHE_TTL", 5*time.Minute)
+	cfg.DNS.CacheNegativeTTL = getDurationOrDefault("DNS_CACHE_NEGATIVE_TTL", time.Minute)
+	cfg.DNS.CacheMaxTTL = getDurationOrDefault("DNS_CACHE_MAX_TTL", time.Hour)
+	cfg.DNS.StatsInterval = getDurationOrDefault("DNS_STATS_INTERVAL", 10*time.Minute)
+
+	cfg.Loop.MaxReceived = getIntOrDefault("LOOP_MAX_RECEIVED", 30)
+	cfg.Loop.MaxPasses = getIntOrDefault("LOOP_MAX_PASSES", 3)
+
+	cfg.ARC.Domain = getOrDefault("ARC_DOMAIN", "maskr.app")
+	cfg.ARC.Selector = getOrDefault("ARC_SELECTOR", "arc")
+	cfg.ARC.PrivateKey = os.Getenv("ARC_PRIVATE_KEY")
+	cfg.ARC.TrustedSealers = getListOrDefault("ARC_TRUSTED_SEALERS", nil)
+
 	cfg.TLS.CertificatePath = os.Getenv("CERTIFICATE")
 	cfg.TLS.PrivateKeyPath = os.Getenv("PRIVATE_KEY")
 
@@ -57,6 +204,8 @@ func New() *Config {
 	cfg.SpamhausToken = os.Getenv("SPAMHAUS_TOKEN")
 	defaultHostname, _ := os.Hostname()
 	cfg.Hostname = getOrDefault("HOSTNAME", defaultHostname)
+	cfg.DataDir = getOrDefault("DATA_DIR", "data")
+	cfg.ReverseAliasDomain = getOrDefault("REVERSE_ALIAS_DOMAIN", "reply.maskr.app")
 	return cfg
 }
 
@@ -67,3 +216,74 @@ func getOrDefault(variable string, def string) string {
 	}
 	return result
 }
+
+func getListOrDefault(variable string, def []string) []string {
+	result, ok := os.LookupEnv(variable)
+	if !ok {
+		return def
+	}
+	var list []string
+	for _, v := range strings.Split(result, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getFloatOrDefault(variable string, def float64) float64 {
+	result, ok := os.LookupEnv(variable)
+	if !ok {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(result, 64)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+// getWeightsOrDefault parses a list like "blacklist=2,reversedns=0.5".
+func getWeightsOrDefault(variable string, def map[string]float64) map[string]float64 {
+	list := getListOrDefault(variable, nil)
+	if list == nil {
+		return def
+	}
+	weights := make(map[string]float64)
+	for _, v := range list {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		weights[strings.TrimSpace(key)] = parsed
+	}
+	return weights
+}
+
+func getIntOrDefault(variable string, def int) int {
+	result, ok := os.LookupEnv(variable)
+	if !ok {
+		return def
+	}
+	parsed, err := strconv.Atoi(result)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+func getDurationOrDefault(variable string, def time.Duration) time.Duration {
+	result, ok := os.LookupEnv(variable)
+	if !ok {
+		return def
+	}
+	parsed, err := time.ParseDuration(result)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
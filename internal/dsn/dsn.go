@@ -0,0 +1,163 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maskrapp/relay/internal/mailer"
+)
+
+// Delivery status notifications as described in RFC 3464, sent when a forwarded message could not be delivered.
+
+var enhancedCodeRegex = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// Failure describes a message that was given up on.
+type Failure struct {
+	// Message is the message that could not be delivered.
+	Message *mailer.Message
+	// Recipient is the recipient reported to the sender. It must not be the real address of a mask owner.
+	Recipient string
+	Arrival   time.Time
+	Err       error
+	// Expired is set when the message was given up on because it stayed in the queue for too long.
+	Expired bool
+}
+
+// Suppress reports whether no notification should be sent about msg: mail from the null sender
+// and automatically submitted mail (RFC 3834) never gets one, to avoid backscatter and loops.
+func Suppress(msg *mailer.Message) bool {
+	if msg.EnvelopeFrom == "" {
+		return true
+	}
+	for _, v := range msg.Headers {
+		if strings.EqualFold(v.Key, "Auto-Submitted") && !strings.EqualFold(strings.TrimSpace(v.Value), "no") {
+			return true
+		}
+	}
+	return false
+}
+
+// Build creates the notification that is sent from the address from to to, on behalf of reportingMTA.
+// The notification has no envelope sender of its own: the mx backend delivers it from the null sender, the other
+// backends from their bounce address, which is not a VERP address and refuses bounces. Either way it never causes
+// another notification.
+func Build(reportingMTA, from, to string, failure Failure) *mailer.Message {
+	status, diagnostic := Classify(failure)
+	now := time.Now()
+	diagnostic = redact(diagnostic, failure)
+	// Other errors come from our side of the delivery, like MX lookups and connections, and name the destination.
+	reason := diagnostic
+	if reason == "" {
+		reason = "the destination does not accept mail"
+		if failure.Expired {
+			reason = "the destination could not be reached"
+		}
+	}
+
+	text := &bytes.Buffer{}
+	fmt.Fprintf(text, "This is the mail system at host %v.\r\n\r\n", reportingMTA)
+	if failure.Expired {
+		fmt.Fprintf(text, "Your message could not be delivered to %v within the time allowed, the delivery was given up on.\r\n\r\n", failure.Recipient)
+	} else {
+		fmt.Fprintf(text, "Your message could not be delivered to %v. This is a permanent error.\r\n\r\n", failure.Recipient)
+	}
+	fmt.Fprintf(text, "The error was: %v\r\n", reason)
+
+	deliveryStatus := &bytes.Buffer{}
+	fmt.Fprintf(deliveryStatus, "Reporting-MTA: dns; %v\r\n", reportingMTA)
+	if !failure.Arrival.IsZero() {
+		fmt.Fprintf(deliveryStatus, "Arrival-Date: %v\r\n", failure.Arrival.Format(time.RFC1123Z))
+	}
+	deliveryStatus.WriteString("\r\n")
+	fmt.Fprintf(deliveryStatus, "Final-Recipient: rfc822; %v\r\n", failure.Recipient)
+	deliveryStatus.WriteString("Action: failed\r\n")
+	fmt.Fprintf(deliveryStatus, "Status: %v\r\n", status)
+	if diagnostic != "" {
+		fmt.Fprintf(deliveryStatus, "Diagnostic-Code: smtp; %v\r\n", diagnostic)
+	}
+	fmt.Fprintf(deliveryStatus, "Last-Attempt-Date: %v\r\n", now.Format(time.RFC1123Z))
+
+	return &mailer.Message{
+		FromName: "Mail Delivery System",
+		From:     from,
+		To:       to,
+		Subject:  "Undelivered Mail Returned to Sender",
+		System:   true,
+		Headers: []mailer.Header{
+			{Key: "Auto-Submitted", Value: "auto-replied"},
+		},
+		Content: mailer.Content{
+			TextBody: text.String(),
+			Report: &mailer.Report{
+				Type: "delivery-status",
+				Parts: []mailer.Attachment{
+					{Filename: "delivery-status.txt", ContentType: "message/delivery-status", Data: deliveryStatus.Bytes()},
+					{Filename: "headers.txt", ContentType: "text/rfc822-headers", Data: originalHeaders(failure)},
+				},
+			},
+		},
+	}
+}
+
+// redact hides the real address of the mask owner and its domain, which remote servers tend to repeat in their replies,
+// from a diagnostic about forwarded mail.
+func redact(diagnostic string, failure Failure) string {
+	owner := failure.Message.To
+	if strings.EqualFold(owner, failure.Recipient) {
+		return diagnostic
+	}
+	diagnostic = regexp.MustCompile("(?i)"+regexp.QuoteMeta(owner)).ReplaceAllLiteralString(diagnostic, failure.Recipient)
+	if i := strings.LastIndex(owner, "@"); i != -1 && i < len(owner)-1 {
+		diagnostic = regexp.MustCompile("(?i)"+regexp.QuoteMeta(owner[i+1:])).ReplaceAllLiteralString(diagnostic, "redacted")
+	}
+	return diagnostic
+}
+
+// Classify returns the RFC 3463 status code of the failure and the SMTP reply it was based on, if any.
+func Classify(failure Failure) (string, string) {
+	var protoErr *textproto.Error
+	if errors.As(failure.Err, &protoErr) {
+		diagnostic := fmt.Sprintf("%v %v", protoErr.Code, strings.ReplaceAll(protoErr.Msg, "\n", " "))
+		if match := enhancedCodeRegex.FindString(protoErr.Msg); match != "" {
+			return match, diagnostic
+		}
+		return fmt.Sprintf("%v.0.0", protoErr.Code/100), diagnostic
+	}
+	if failure.Expired {
+		// 4.4.7: delivery time expired.
+		return "4.4.7", ""
+	}
+	return "5.0.0", ""
+}
+
+// originalHeaders reconstructs the headers of the original message as the sender knows them, without the real address of the mask owner.
+func originalHeaders(failure Failure) []byte {
+	buf := &bytes.Buffer{}
+	msg := failure.Message
+	from := msg.EnvelopeFrom
+	to := failure.Recipient
+	for _, v := range msg.Headers {
+		switch v.Key {
+		case "X-Original-From":
+			from = v.Value
+		case "X-Original-To":
+			to = v.Value
+		}
+	}
+	fmt.Fprintf(buf, "From: %v\r\n", from)
+	fmt.Fprintf(buf, "To: %v\r\n", to)
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	for _, v := range msg.Headers {
+		switch v.Key {
+		case "Date", "Message-ID", "In-Reply-To", "References":
+			fmt.Fprintf(buf, "%v: %v\r\n", v.Key, v.Value)
+		}
+	}
+	return buf.Bytes()
+}
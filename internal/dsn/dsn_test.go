@@ -0,0 +1,79 @@
+package dsn_test
+
+import (
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maskrapp/relay/internal/dsn"
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuppress(t *testing.T) {
+	assert.True(t, dsn.Suppress(&mailer.Message{EnvelopeFrom: ""}))
+	assert.True(t, dsn.Suppress(&mailer.Message{
+		EnvelopeFrom: "alice@example.com",
+		Headers:      []mailer.Header{{Key: "Auto-Submitted", Value: "auto-generated"}},
+	}))
+	assert.False(t, dsn.Suppress(&mailer.Message{
+		EnvelopeFrom: "alice@example.com",
+		Headers:      []mailer.Header{{Key: "Auto-Submitted", Value: "no"}},
+	}))
+}
+
+func TestBuild(t *testing.T) {
+	original := &mailer.Message{
+		From:         "mask@maskr.app",
+		To:           "owner@example.net",
+		EnvelopeFrom: "alice@example.com",
+		Subject:      "Hello",
+		Headers: []mailer.Header{
+			{Key: "X-Original-From", Value: "Alice <alice@example.com>"},
+			{Key: "X-Original-To", Value: "mask@maskr.app"},
+			{Key: "Message-ID", Value: "<hello@example.com>"},
+		},
+	}
+	notification := dsn.Build("relay.maskr.app", "mailer-daemon@maskr.app", "alice@example.com", dsn.Failure{
+		Message:   original,
+		Recipient: "mask@maskr.app",
+		Arrival:   time.Now(),
+		Err:       &textproto.Error{Code: 550, Msg: "5.1.1 <Owner@example.net>: Recipient address rejected by mx.example.net"},
+	})
+	assert.Equal(t, "", notification.EnvelopeFrom)
+	assert.True(t, dsn.Suppress(notification))
+	assert.True(t, notification.System)
+
+	data, err := notification.Bytes()
+	assert.NoError(t, err)
+	assert.NotContains(t, strings.ToLower(string(data)), "example.net")
+	assert.Contains(t, string(data), "<mask@maskr.app>: Recipient address rejected by mx.redacted")
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.NoError(t, err)
+	assert.Contains(t, parsed.Header.Get("Content-Type"), "multipart/report")
+	assert.Contains(t, parsed.Header.Get("Content-Type"), "report-type=delivery-status")
+	assert.Contains(t, string(data), "Status: 5.1.1")
+	assert.Contains(t, string(data), "Final-Recipient: rfc822; mask@maskr.app")
+	assert.Contains(t, string(data), "Message-ID: <hello@example.com>")
+}
+
+func TestBuildHidesLocalErrors(t *testing.T) {
+	original := &mailer.Message{From: "mask@maskr.app", To: "owner@example.net", EnvelopeFrom: "alice@example.com"}
+	tests := map[string]dsn.Failure{
+		"the destination does not accept mail": {Err: &mailer.PermanentError{Err: errors.New("lookup example.net on 10.0.0.2:53: no such host")}},
+		"the destination could not be reached": {Err: errors.New("dial tcp mx.example.net:25: connection refused"), Expired: true},
+	}
+	for reason, failure := range tests {
+		failure.Message = original
+		failure.Recipient = "mask@maskr.app"
+		data, err := dsn.Build("relay.maskr.app", "mailer-daemon@maskr.app", "alice@example.com", failure).Bytes()
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "The error was: "+reason)
+		assert.NotContains(t, string(data), "example.net")
+		assert.NotContains(t, string(data), "10.0.0.2")
+	}
+}
@@ -6,10 +6,16 @@ import (
 
 	"github.com/maskrapp/relay/internal/config"
 	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/store"
 )
 
 type Instances struct {
 	GrpcClient main_api.MainAPIServiceClient
+	Store      store.Store
+	// Resolver answers the DNS lookups of the checks, DNSBLResolver the DNSBL queries.
+	Resolver      resolver.Resolver
+	DNSBLResolver resolver.Resolver
 }
 
 type Context interface {
@@ -0,0 +1,76 @@
+package loop
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/maskrapp/relay/internal/mailer"
+)
+
+// Header lists every pass of a message through the relay. Only the first value of a header survives some
+// delivery backends, so the passes are kept in a single comma separated field.
+const Header = "X-Maskr-Loop"
+
+// Error is returned for a message that went around in a loop, e.g. a mask forwarding to another mask that forwards back.
+type Error struct {
+	Reason string
+	Hops   int
+}
+
+func (e *Error) Error() string {
+	// 5.4.6: routing loop detected (RFC 3463).
+	return fmt.Sprintf("5.4.6 mail loop detected: %v", e.Reason)
+}
+
+type Detector struct {
+	hostname    string
+	maxReceived int
+	maxPasses   int
+}
+
+// New creates a detector that rejects messages with more than maxReceived Received fields,
+// or that passed through the relay at hostname maxPasses times before.
+func New(hostname string, maxReceived, maxPasses int) *Detector {
+	return &Detector{hostname: hostname, maxReceived: maxReceived, maxPasses: maxPasses}
+}
+
+// Check inspects the header of an incoming message, including the Received field the relay added to it.
+func (d *Detector) Check(header mail.Header) error {
+	received := header["Received"]
+	if len(received) > d.maxReceived {
+		return &Error{Reason: fmt.Sprintf("%v Received fields", len(received)), Hops: len(received)}
+	}
+	// The first Received field is the one just added for this pass.
+	ours := 0
+	for i, v := range received {
+		if i > 0 && strings.Contains(strings.ToLower(v), "by "+strings.ToLower(d.hostname)+" ") {
+			ours++
+		}
+	}
+	passes := len(passes(header))
+	if ours > passes {
+		passes = ours
+	}
+	if passes >= d.maxPasses {
+		return &Error{Reason: fmt.Sprintf("passed through %v %v times", d.hostname, passes), Hops: len(received)}
+	}
+	return nil
+}
+
+// Next returns the loop header for the forwarded message, with this pass added.
+func (d *Detector) Next(header mail.Header) mailer.Header {
+	return mailer.Header{Key: Header, Value: strings.Join(append(passes(header), d.hostname), ", ")}
+}
+
+func passes(header mail.Header) []string {
+	var result []string
+	for _, value := range header[Header] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
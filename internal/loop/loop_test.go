@@ -0,0 +1,49 @@
+package loop_test
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/loop"
+	"github.com/stretchr/testify/assert"
+)
+
+const ours = "from mail.example.com (mail.example.com [192.0.2.1]) by mx.maskr.app (maskr relay) with ESMTPS id abc for <mask@maskr.app>; Mon, 02 Jan 2023 15:04:05 +0000"
+
+func header(received int, passes string) mail.Header {
+	h := mail.Header{"Received": {ours}}
+	for i := 1; i < received; i++ {
+		h["Received"] = append(h["Received"], "from a (b [192.0.2.2]) by mx.example.com with ESMTP; Mon, 02 Jan 2023 15:04:05 +0000")
+	}
+	if passes != "" {
+		h[loop.Header] = []string{passes}
+	}
+	return h
+}
+
+func TestDetector(t *testing.T) {
+	detector := loop.New("mx.maskr.app", 10, 3)
+
+	assert.NoError(t, detector.Check(header(3, "")))
+	assert.NoError(t, detector.Check(header(3, "mx.maskr.app, mx.maskr.app")))
+
+	var loopErr *loop.Error
+	err := detector.Check(header(3, "mx.maskr.app, mx.maskr.app, mx.maskr.app"))
+	assert.True(t, errors.As(err, &loopErr))
+	assert.True(t, strings.HasPrefix(err.Error(), "5.4.6 "))
+
+	assert.Error(t, detector.Check(header(11, "")))
+
+	// Our own Received fields from earlier passes count too.
+	h := header(1, "")
+	h["Received"] = append(h["Received"], ours, ours, ours)
+	assert.Error(t, detector.Check(h))
+}
+
+func TestNext(t *testing.T) {
+	detector := loop.New("mx.maskr.app", 10, 3)
+	assert.Equal(t, "mx.maskr.app", detector.Next(header(1, "")).Value)
+	assert.Equal(t, "mx.maskr.app, mx.maskr.app", detector.Next(header(1, "mx.maskr.app")).Value)
+}
@@ -0,0 +1,399 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const maxMultipartDepth = 16
+
+var ErrContentTooLarge = errors.New("message content exceeds the configured size limit")
+
+// Content is the body of a forwarded message.
+type Content struct {
+	TextBody string
+	HTMLBody string
+	// Calendar is a text/calendar invitation, rendered as an alternative to the text and HTML bodies.
+	Calendar    *Attachment
+	Attachments []Attachment
+	// Report turns the message into a multipart/report, with TextBody as its human readable part.
+	Report *Report
+}
+
+// Report is the machine readable part of a multipart/report message (RFC 6522).
+type Report struct {
+	// Type is the report-type parameter, e.g. delivery-status.
+	Type string
+	// Parts follow the human readable part. They are written without transfer encoding, as required for message/* types.
+	Parts []Attachment
+}
+
+// Attachment is a non-body MIME part of a forwarded message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	// ContentID is set for inline parts that the HTML body references through cid: URLs.
+	ContentID string
+	Data      []byte
+}
+
+// Limits bounds the decoded size of the parts kept when parsing a message. Zero disables a limit.
+type Limits struct {
+	MaxAttachmentSize int
+	MaxTotalSize      int
+}
+
+// ParseContent walks the MIME tree of a message and collects its bodies, attachments, inline parts and calendar invitations.
+func ParseContent(header textproto.MIMEHeader, body io.Reader, limits Limits) (*Content, error) {
+	parser := &contentParser{limits: limits, content: &Content{}}
+	if err := parser.walk(header, body, 0); err != nil {
+		return nil, err
+	}
+	return parser.content, nil
+}
+
+type contentParser struct {
+	limits  Limits
+	content *Content
+	total   int
+}
+
+func (p *contentParser) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxMultipartDepth {
+		return fmt.Errorf("multipart nesting exceeds %v levels", maxMultipartDepth)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := p.decode(header, body)
+	if err != nil {
+		return err
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := decodeWord(dispositionParams["filename"])
+	if filename == "" {
+		filename = decodeWord(params["name"])
+	}
+	isAttachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment:
+		p.content.TextBody += toUTF8(data, params["charset"])
+	case mediaType == "text/html" && !isAttachment:
+		p.content.HTMLBody += toUTF8(data, params["charset"])
+	case mediaType == "text/calendar" && !isAttachment && p.content.Calendar == nil:
+		p.content.Calendar = &Attachment{
+			Filename:    "invite.ics",
+			ContentType: formatMediaType(mediaType, params),
+			Data:        data,
+		}
+	default:
+		if filename == "" && mediaType == "message/rfc822" {
+			filename = "forwarded.eml"
+		}
+		p.content.Attachments = append(p.content.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			ContentID:   strings.Trim(header.Get("Content-Id"), "<> "),
+			Data:        data,
+		})
+	}
+	return nil
+}
+
+func (p *contentParser) decode(header textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{body})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(body)
+	default:
+		reader = body
+	}
+	limit := p.limits.MaxAttachmentSize
+	if p.limits.MaxTotalSize > 0 && (limit == 0 || p.limits.MaxTotalSize-p.total < limit) {
+		limit = p.limits.MaxTotalSize - p.total
+	}
+	if limit > 0 {
+		reader = io.LimitReader(reader, int64(limit)+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(data) > limit {
+		return nil, ErrContentTooLarge
+	}
+	p.total += len(data)
+	return data, nil
+}
+
+// base64Cleaner drops the characters that are not part of the base64 alphabet, which some senders wrap lines with.
+type base64Cleaner struct {
+	reader io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		b := p[i]
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '+' || b == '/' || b == '=' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+func toUTF8(data []byte, charset string) string {
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(data)
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+func decodeWord(s string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+func formatMediaType(mediaType string, params map[string]string) string {
+	kept := map[string]string{"charset": "utf-8"}
+	if method, ok := params["method"]; ok {
+		kept["method"] = method
+	}
+	return mime.FormatMediaType(mediaType, kept)
+}
+
+func (a *Attachment) isInline() bool {
+	return a.ContentID != ""
+}
+
+func (c *Content) hasInline() bool {
+	for _, v := range c.Attachments {
+		if v.isInline() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Content) hasAttachments() bool {
+	for _, v := range c.Attachments {
+		if !v.isInline() {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the Content-Type and the encoded MIME tree of c.
+// Inline parts are wrapped in multipart/related and attachments in multipart/mixed, only when present.
+func (c *Content) render() (string, []byte, error) {
+	if c.Report != nil {
+		return c.renderReport()
+	}
+	contentType, body, err := c.renderRelated()
+	if err != nil || !c.hasAttachments() {
+		return contentType, body, err
+	}
+	return renderMultipart("multipart/mixed", nil, func(writer *multipart.Writer) error {
+		if err := writeNested(writer, contentType, body); err != nil {
+			return err
+		}
+		for _, v := range c.Attachments {
+			if v.isInline() {
+				continue
+			}
+			if err := writeAttachment(writer, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Content) renderReport() (string, []byte, error) {
+	params := map[string]string{"report-type": c.Report.Type}
+	return renderMultipart("multipart/report", params, func(writer *multipart.Writer) error {
+		if err := writeTextPart(writer, "text/plain; charset=utf-8", c.TextBody); err != nil {
+			return err
+		}
+		for _, v := range c.Report.Parts {
+			if err := writeNested(writer, v.ContentType, v.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Content) renderRelated() (string, []byte, error) {
+	contentType, body, err := c.renderAlternative()
+	if err != nil || !c.hasInline() {
+		return contentType, body, err
+	}
+	return renderMultipart("multipart/related", nil, func(writer *multipart.Writer) error {
+		if err := writeNested(writer, contentType, body); err != nil {
+			return err
+		}
+		for _, v := range c.Attachments {
+			if !v.isInline() {
+				continue
+			}
+			if err := writeAttachment(writer, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Content) renderAlternative() (string, []byte, error) {
+	return renderMultipart("multipart/alternative", nil, func(writer *multipart.Writer) error {
+		if c.TextBody != "" {
+			if err := writeTextPart(writer, "text/plain; charset=utf-8", c.TextBody); err != nil {
+				return err
+			}
+		}
+		if c.HTMLBody != "" {
+			if err := writeTextPart(writer, "text/html; charset=utf-8", c.HTMLBody); err != nil {
+				return err
+			}
+		}
+		if c.Calendar != nil {
+			if err := writeTextPart(writer, c.Calendar.ContentType, string(c.Calendar.Data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func renderMultipart(mediaType string, params map[string]string, writeParts func(*multipart.Writer) error) (string, []byte, error) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	if err := writeParts(writer); err != nil {
+		return "", nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return "", nil, err
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["boundary"] = writer.Boundary()
+	return mime.FormatMediaType(mediaType, params), buf.Bytes(), nil
+}
+
+func writeNested(writer *multipart.Writer, contentType string, body []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(body)
+	return err
+}
+
+func writeAttachment(writer *multipart.Writer, attachment Attachment) error {
+	header := textproto.MIMEHeader{}
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	params := map[string]string{}
+	dispositionParams := map[string]string{}
+	if attachment.Filename != "" {
+		params["name"] = attachment.Filename
+		dispositionParams["filename"] = attachment.Filename
+	}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, params))
+	header.Set("Content-Transfer-Encoding", "base64")
+	if attachment.isInline() {
+		header.Set("Content-ID", "<"+attachment.ContentID+">")
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", dispositionParams))
+	} else {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", dispositionParams))
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{writer: part})
+	if _, err := encoder.Write(attachment.Data); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// lineWrapper breaks base64 output into 76 character lines, as required by RFC 2045.
+type lineWrapper struct {
+	writer io.Writer
+	column int
+}
+
+func (w *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := 76 - w.column
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.writer.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		w.column += n
+		p = p[n:]
+		if w.column == 76 {
+			if _, err := w.writer.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			w.column = 0
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,106 @@
+package mailer_test
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/stretchr/testify/assert"
+)
+
+const invitation = "From: alice@example.com\r\n" +
+	"Subject: Invitation\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+	"\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: multipart/related; boundary=\"related\"\r\n" +
+	"\r\n" +
+	"--related\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alternative\"\r\n" +
+	"\r\n" +
+	"--alternative\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9\r\n" +
+	"--alternative\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<img src=\"cid:logo\">\r\n" +
+	"--alternative\r\n" +
+	"Content-Type: text/calendar; charset=utf-8; method=REQUEST\r\n" +
+	"\r\n" +
+	"BEGIN:VCALENDAR\r\n" +
+	"--alternative--\r\n" +
+	"--related\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--related--\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"LjQ=\r\n" +
+	"--mixed--\r\n"
+
+func parse(t *testing.T, raw string, limits mailer.Limits) (*mailer.Content, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	assert.NoError(t, err)
+	return mailer.ParseContent(textproto.MIMEHeader(msg.Header), msg.Body, limits)
+}
+
+func TestParseContent(t *testing.T) {
+	content, err := parse(t, invitation, mailer.Limits{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Café", strings.TrimSpace(content.TextBody))
+	assert.Equal(t, "<img src=\"cid:logo\">", strings.TrimSpace(content.HTMLBody))
+	assert.NotNil(t, content.Calendar)
+	assert.Contains(t, content.Calendar.ContentType, "method=REQUEST")
+	assert.Len(t, content.Attachments, 2)
+	assert.Equal(t, "logo", content.Attachments[0].ContentID)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n", string(content.Attachments[0].Data))
+	assert.Equal(t, "invoice.pdf", content.Attachments[1].Filename)
+	assert.Equal(t, "%PDF-1.4", string(content.Attachments[1].Data))
+}
+
+func TestParseContentLimits(t *testing.T) {
+	_, err := parse(t, invitation, mailer.Limits{MaxAttachmentSize: 4})
+	assert.ErrorIs(t, err, mailer.ErrContentTooLarge)
+}
+
+func TestRenderContent(t *testing.T) {
+	content, err := parse(t, invitation, mailer.Limits{})
+	assert.NoError(t, err)
+	msg := &mailer.Message{From: "mask@maskr.app", To: "user@example.com", Content: *content}
+	data, err := msg.Bytes()
+	assert.NoError(t, err)
+
+	rendered, err := parse(t, string(data), mailer.Limits{})
+	assert.NoError(t, err)
+	assert.Equal(t, content, rendered)
+}
+
+func TestRenderAttachmentWithoutFilename(t *testing.T) {
+	msg := &mailer.Message{From: "mask@maskr.app", To: "user@example.com", Content: mailer.Content{
+		TextBody: "See attached",
+		HTMLBody: "<img src=\"cid:logo\">",
+		Attachments: []mailer.Attachment{
+			{ContentType: "image/png", ContentID: "logo", Data: []byte("\x89PNG")},
+			{ContentType: "text/plain", Data: []byte("notes")},
+		},
+	}}
+	data, err := msg.Bytes()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "Content-Disposition: inline\r\n")
+	assert.Contains(t, string(data), "Content-Disposition: attachment\r\n")
+	assert.NotContains(t, string(data), "filename")
+	assert.NotContains(t, string(data), "name=")
+}
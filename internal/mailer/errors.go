@@ -0,0 +1,30 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+)
+
+// PermanentError is returned by a backend when retrying the delivery cannot succeed, e.g. because the recipient does not exist.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// IsPermanent reports whether a delivery error should not be retried.
+// SMTP replies in the 5xx range are permanent as per RFC 5321 section 4.2.1.
+func IsPermanent(err error) bool {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return true
+	}
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileForwarder writes forwarded mail to a file or stdout instead of delivering it. It is meant for development.
+type FileForwarder struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewFileForwarder(writer io.Writer) *FileForwarder {
+	return &FileForwarder{writer: writer}
+}
+
+func (f *FileForwarder) ForwardMail(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, err = fmt.Fprintf(f.writer, "----- forwarded to %v at %v -----\r\n%s\r\n", msg.To, time.Now().Format(time.RFC3339), data)
+	return err
+}
+
+// Close closes the writer if it is an io.Closer other than stdout.
+func (f *FileForwarder) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	closer, ok := f.writer.(io.Closer)
+	if !ok || f.writer == os.Stdout {
+		return nil
+	}
+	return closer.Close()
+}
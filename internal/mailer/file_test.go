@@ -0,0 +1,50 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileForwarder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	forwarder := mailer.NewFileForwarder(buf)
+	err := forwarder.ForwardMail(context.Background(), &mailer.Message{
+		FromName: "Alice",
+		From:     "mask@maskr.app",
+		To:       "user@example.com",
+		Subject:  "Hello",
+		Content: mailer.Content{
+			TextBody: "hello world",
+			HTMLBody: "<p>hello world</p>",
+		},
+	})
+	assert.NoError(t, err)
+
+	_, raw, _ := strings.Cut(buf.String(), "\r\n")
+	parsed, err := mail.ReadMessage(strings.NewReader(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, `"Alice" <mask@maskr.app>`, parsed.Header.Get("From"))
+	assert.Equal(t, "<user@example.com>", parsed.Header.Get("To"))
+	assert.Equal(t, "Hello", parsed.Header.Get("Subject"))
+	assert.True(t, strings.HasPrefix(parsed.Header.Get("Content-Type"), "multipart/alternative"))
+}
+
+func TestFileForwarderClose(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "mail"))
+	assert.NoError(t, err)
+	forwarder := mailer.NewFileForwarder(file)
+	assert.NoError(t, forwarder.Close())
+	assert.ErrorIs(t, file.Close(), os.ErrClosed)
+
+	// Stdout stays open for the rest of the process.
+	assert.NoError(t, mailer.NewFileForwarder(os.Stdout).Close())
+	assert.NoError(t, mailer.NewFileForwarder(&bytes.Buffer{}).Close())
+}
@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Header is a header field written to the forwarded message as-is.
+type Header struct {
+	Key   string
+	Value string
+}
+
+// threadingHeaders let mail clients thread a conversation.
+var threadingHeaders = []string{"Message-Id", "Date", "In-Reply-To", "References"}
+
+// correspondenceHeaders describe who else takes part in a conversation and how to leave it.
+var correspondenceHeaders = []string{"Cc", "Reply-To", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post", "Auto-Submitted"}
+
+// traceHeaders are added by the relay itself and rendered above all other fields (RFC 5322 section 3.6.7).
+var traceHeaders = map[string]bool{
+	"Received":               true,
+	"Received-Spf":           true,
+	"Authentication-Results": true,
+}
+
+// ForwardHeaders returns the headers of an incoming message that are carried over when it is forwarded to the owner of mask.
+// The original Reply-To is dropped when the forwarded message gets a reverse alias instead.
+func ForwardHeaders(original mail.Header, mask string, hasReverseAlias bool) []Header {
+	headers := make([]Header, 0)
+	if from := original.Get("From"); from != "" {
+		headers = append(headers, Header{Key: "X-Original-From", Value: from})
+	}
+	headers = append(headers, Header{Key: "X-Original-To", Value: mask})
+	headers = append(headers, copyHeaders(original, threadingHeaders)...)
+	for _, v := range copyHeaders(original, correspondenceHeaders) {
+		if hasReverseAlias && v.Key == "Reply-To" {
+			continue
+		}
+		headers = append(headers, v)
+	}
+	return headers
+}
+
+// ReplyHeaders returns the headers of a reply from a mask owner that are carried over when it is delivered to the contact.
+// The Message-ID is not kept because it reveals the mail provider of the owner.
+func ReplyHeaders(original mail.Header) []Header {
+	return copyHeaders(original, []string{"Date", "In-Reply-To", "References"})
+}
+
+func copyHeaders(original mail.Header, keys []string) []Header {
+	headers := make([]Header, 0)
+	for _, key := range keys {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		for _, value := range original[key] {
+			headers = append(headers, Header{Key: displayKey(key), Value: value})
+		}
+	}
+	return headers
+}
+
+func displayKey(key string) string {
+	if key == "Message-Id" {
+		return "Message-ID"
+	}
+	return key
+}
+
+func (msg *Message) hasHeader(key string) bool {
+	for _, v := range msg.Headers {
+		if strings.EqualFold(v.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHeader writes a header field, folding it at whitespace so lines stay within the RFC 5322 limits.
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	line := key + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > 76 && strings.TrimSpace(line) != key+":" {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	buf.WriteString(line + "\r\n")
+}
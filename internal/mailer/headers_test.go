@@ -0,0 +1,80 @@
+package mailer_test
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/stretchr/testify/assert"
+)
+
+const threaded = "From: Alice <alice@example.com>\r\n" +
+	"To: mask@maskr.app\r\n" +
+	"Cc: bob@example.com\r\n" +
+	"Reply-To: list@example.com\r\n" +
+	"Subject: Re: Lunch\r\n" +
+	"Date: Mon, 02 Jan 2023 15:04:05 +0000\r\n" +
+	"Message-ID: <reply@example.com>\r\n" +
+	"In-Reply-To: <original@example.com>\r\n" +
+	"References: <first@example.com>\r\n" +
+	" <original@example.com>\r\n" +
+	"X-Originating-IP: [192.0.2.1]\r\n" +
+	"\r\n" +
+	"see you there\r\n"
+
+func TestForwardHeaders(t *testing.T) {
+	original, err := mail.ReadMessage(strings.NewReader(threaded))
+	assert.NoError(t, err)
+
+	msg := &mailer.Message{
+		From:    "mask@maskr.app",
+		To:      "user@example.com",
+		Subject: "Re: Lunch",
+		Headers: mailer.ForwardHeaders(original.Header, "mask@maskr.app", false),
+		Content: mailer.Content{TextBody: "see you there"},
+	}
+	data, err := msg.Bytes()
+	assert.NoError(t, err)
+
+	forwarded, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"<reply@example.com>"}, forwarded.Header["Message-Id"])
+	assert.Equal(t, []string{"Mon, 02 Jan 2023 15:04:05 +0000"}, forwarded.Header["Date"])
+	assert.Equal(t, "<original@example.com>", forwarded.Header.Get("In-Reply-To"))
+	assert.Equal(t, "<first@example.com> <original@example.com>", forwarded.Header.Get("References"))
+	assert.Equal(t, "bob@example.com", forwarded.Header.Get("Cc"))
+	assert.Equal(t, "list@example.com", forwarded.Header.Get("Reply-To"))
+	assert.Equal(t, "Alice <alice@example.com>", forwarded.Header.Get("X-Original-From"))
+	assert.Equal(t, "mask@maskr.app", forwarded.Header.Get("X-Original-To"))
+	assert.Empty(t, forwarded.Header.Get("X-Originating-Ip"))
+}
+
+func TestForwardHeadersWithReverseAlias(t *testing.T) {
+	original, err := mail.ReadMessage(strings.NewReader(threaded))
+	assert.NoError(t, err)
+
+	for _, v := range mailer.ForwardHeaders(original.Header, "mask@maskr.app", true) {
+		assert.NotEqual(t, "Reply-To", v.Key)
+	}
+	for _, v := range mailer.ReplyHeaders(original.Header) {
+		assert.NotEqual(t, "Message-ID", v.Key)
+	}
+}
+
+func TestTraceHeadersOnTop(t *testing.T) {
+	msg := &mailer.Message{
+		From:    "mask@maskr.app",
+		To:      "user@example.com",
+		Subject: "Hello",
+		Headers: []mailer.Header{
+			{Key: "Cc", Value: "bob@example.com"},
+			{Key: "Received", Value: "from mail.example.com (mail.example.com [192.0.2.1]) by mx.maskr.app (maskr relay) with ESMTPS id abc for <mask@maskr.app>; Mon, 02 Jan 2023 15:04:05 +0000"},
+		},
+		Content: mailer.Content{TextBody: "hello"},
+	}
+	data, err := msg.Bytes()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "Received: from mail.example.com"))
+	assert.LessOrEqual(t, strings.Index(string(data), "\r\n"), 78, "long trace fields are folded")
+}
@@ -1,81 +1,72 @@
 package mailer
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"net/http"
-	"time"
-)
-
-type Mailer struct {
-	token      string
-	httpClient *http.Client
-}
+	"os"
 
-func New(token string) *Mailer {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.MaxIdleConnsPerHost = 100
-	transport.MaxConnsPerHost = 100
-	transport.MaxIdleConnsPerHost = 100
+	"github.com/maskrapp/relay/internal/config"
+	"github.com/maskrapp/relay/internal/srs"
+)
 
-	return &Mailer{
-		token: token,
-		httpClient: &http.Client{
-			Timeout:   10 * time.Second,
-			Transport: transport,
-		}}
+// Message is a forwarded email, independent of the backend that delivers it.
+type Message struct {
+	// FromName is the display name of the original sender.
+	FromName string
+	// From is the mask address the message is sent from.
+	From string
+	// To is the real address of the mask owner, or the contact for replies.
+	To string
+	// ReplyTo is the reverse alias replies to this message should go to, if any.
+	ReplyTo string
+	// EnvelopeFrom is the envelope sender of the original message, empty for null senders.
+	EnvelopeFrom string
+	// BounceAddress is the envelope sender the message is delivered with. When it is empty the backend picks one.
+	BounceAddress string
+	// MessageId is the ID in the VERP bounce address of a forwarded message, bounces are reported under it.
+	MessageId string
+	Subject   string
+	// Reply is set for mail from a mask owner to a contact through a reverse alias.
+	Reply bool
+	// System is set for mail the relay sends on its own, like reports and notifications, which belongs to no mask.
+	System bool
+	// Headers are carried over from the original message.
+	Headers []Header
+	// AuthenticationResults are the verdicts of the checks on the original message, formatted as an RFC 8601 header value.
+	AuthenticationResults string
+	// Raw is the rendered message. When it is set, it is delivered as is instead of being rendered from the other fields.
+	Raw []byte `json:"-"`
+	Content
 }
 
-func (m *Mailer) createEmailJSON(email string) []map[string]interface{} {
-	data := make([]map[string]interface{}, 0)
-	entry := map[string]interface{}{
-		"email_address": map[string]interface{}{
-			"address": email,
-		},
-	}
-	data = append(data, entry)
-	return data
+// Forwarder delivers forwarded mail to its final destination.
+type Forwarder interface {
+	ForwardMail(ctx context.Context, msg *Message) error
 }
 
-func (m *Mailer) ForwardMail(sender, forwardAddress, realEmail, subject, htmlBody, textBody string) error {
-	body := map[string]interface{}{
-		"bounce_address": "bounce@bounce.maskr.app",
-		"htmlbody":       htmlBody,
-		"textbody":       textBody,
-		"subject":        subject,
-		"from": map[string]interface{}{
-			"address": forwardAddress,
-			"name":    sender,
-		},
-		"to": m.createEmailJSON(realEmail),
-	}
-	data, err := json.Marshal(body)
-	if err != nil {
-		return err
-	}
-	request, err := http.NewRequest("POST", "https://api.zeptomail.eu/v1.1/email", bytes.NewBuffer(data))
-	if err != nil {
-		return err
-
-	}
-	authHeader := fmt.Sprintf("Zoho-enczapikey %v", m.token)
-	request.Header = map[string][]string{
-		"Accept":        {"application/json"},
-		"Content-Type":  {"application/json"},
-		"Authorization": {authHeader},
-	}
-	resp, err := m.httpClient.Do(request)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	var res map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&res)
-	if resp.StatusCode != 201 {
-		errorMessage := fmt.Sprintf("expected status code 201, got: %v with response body: %v", resp.StatusCode, res)
-		return errors.New(errorMessage)
+// New returns the Forwarder selected by cfg.Mailer.Backend.
+func New(cfg *config.Config) (Forwarder, error) {
+	switch cfg.Mailer.Backend {
+	case "zeptomail":
+		return NewZeptoMail(cfg.ZeptoMail.EmailToken, cfg.Mailer.BounceAddress), nil
+	case "smtp":
+		return NewSMTPRelay(cfg.SMTPRelay.Address, cfg.SMTPRelay.Username, cfg.SMTPRelay.Password, cfg.Hostname, cfg.Mailer.BounceAddress), nil
+	case "mx":
+		rewriter, err := srs.New(cfg.SRS.Secret, cfg.SRS.Domain)
+		if err != nil {
+			return nil, err
+		}
+		return NewMXDelivery(cfg.Hostname, rewriter), nil
+	case "file":
+		if cfg.Mailer.FilePath == "" || cfg.Mailer.FilePath == "-" {
+			return NewFileForwarder(os.Stdout), nil
+		}
+		file, err := os.OpenFile(cfg.Mailer.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileForwarder(file), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer backend: %v", cfg.Mailer.Backend)
 	}
-	return err
 }
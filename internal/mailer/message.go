@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Bytes renders msg as an RFC 5322 message, for backends that speak SMTP or write to disk.
+func (msg *Message) Bytes() ([]byte, error) {
+	if msg.Raw != nil {
+		return msg.Raw, nil
+	}
+	buf := &bytes.Buffer{}
+	for _, v := range msg.Headers {
+		if traceHeaders[textproto.CanonicalMIMEHeaderKey(v.Key)] {
+			writeHeader(buf, v.Key, v.Value)
+		}
+	}
+	from := mail.Address{Name: msg.FromName, Address: msg.From}
+	to := mail.Address{Address: msg.To}
+	fmt.Fprintf(buf, "From: %v\r\n", from.String())
+	fmt.Fprintf(buf, "To: %v\r\n", to.String())
+	if msg.ReplyTo != "" {
+		replyTo := mail.Address{Name: msg.FromName, Address: msg.ReplyTo}
+		fmt.Fprintf(buf, "Reply-To: %v\r\n", replyTo.String())
+	}
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	if !msg.hasHeader("Date") {
+		fmt.Fprintf(buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	}
+	if !msg.hasHeader("Message-ID") {
+		fmt.Fprintf(buf, "Message-ID: %v\r\n", generateMessageId(msg.From))
+	}
+	for _, v := range msg.Headers {
+		if !traceHeaders[textproto.CanonicalMIMEHeaderKey(v.Key)] {
+			writeHeader(buf, v.Key, v.Value)
+		}
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	contentType, body, err := msg.render()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(buf, "Content-Type: %v\r\n\r\n", contentType)
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func writeTextPart(writer *multipart.Writer, contentType, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func generateMessageId(address string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		domain = address[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%v@%v>", hex.EncodeToString(b), domain)
+}
@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maskrapp/relay/internal/srs"
+)
+
+// MXResolver looks up the mail exchangers of a domain. *net.Resolver satisfies it.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// MXDelivery delivers forwarded mail directly to the recipient's mail exchangers.
+// Unless the message has its own bounce address, the envelope sender is rewritten with SRS so SPF passes at the destination.
+type MXDelivery struct {
+	hostname string
+	rewriter *srs.Rewriter
+	// Resolver is used to look up the recipient's MX records.
+	Resolver MXResolver
+	// Port is the SMTP port of the mail exchangers, 25 unless overridden for tests.
+	Port string
+}
+
+func NewMXDelivery(hostname string, rewriter *srs.Rewriter) *MXDelivery {
+	return &MXDelivery{
+		hostname: hostname,
+		rewriter: rewriter,
+		Resolver: net.DefaultResolver,
+		Port:     "25",
+	}
+}
+
+func (d *MXDelivery) ForwardMail(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	envelopeFrom := msg.BounceAddress
+	if envelopeFrom == "" && msg.EnvelopeFrom != "" {
+		envelopeFrom, err = d.rewriter.Forward(msg.EnvelopeFrom)
+		if err != nil {
+			return err
+		}
+	}
+	i := strings.LastIndex(msg.To, "@")
+	if i == -1 {
+		return &PermanentError{Err: fmt.Errorf("invalid recipient address: %v", msg.To)}
+	}
+	hosts, err := d.lookupHosts(ctx, msg.To[i+1:])
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		lastErr = d.deliver(ctx, host, envelopeFrom, msg.To, data)
+		if lastErr == nil {
+			return nil
+		}
+		// A permanent rejection from one exchanger will not be different on the others.
+		if IsPermanent(lastErr) {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+func (d *MXDelivery) lookupHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := d.Resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		// RFC 5321 section 5.1: without MX records the domain itself is the implicit MX.
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	hosts := make([]string, 0, len(records))
+	for _, v := range records {
+		host := strings.TrimSuffix(v.Host, ".")
+		// RFC 7505 null MX: the domain does not accept mail.
+		if host == "" {
+			return nil, &PermanentError{Err: fmt.Errorf("domain %v does not accept mail (null MX)", domain)}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func (d *MXDelivery) deliver(ctx context.Context, host, from, to string, data []byte) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, d.Port))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Hello(d.hostname); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		// Opportunistic TLS (RFC 7435): most exchangers do not present a certificate matching their MX name.
+		if err := client.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
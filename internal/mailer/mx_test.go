@@ -0,0 +1,89 @@
+package mailer_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/srs"
+	"github.com/maskrapp/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMXResolver map[string][]*net.MX
+
+func (r fakeMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// startSink starts a local SMTP server that hands every received message to the returned channel.
+// smtpd waits up to five seconds for a PROXY protocol header before greeting, so every session starts slowly.
+func startSink(t *testing.T) (string, <-chan smtpd.HandlerData) {
+	received := make(chan smtpd.HandlerData, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &smtpd.Server{
+		Hostname: "sink.test",
+		Timeout:  time.Second * 5,
+		Handler: func(data smtpd.HandlerData) error {
+			received <- data
+			return nil
+		},
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, received
+}
+
+func TestMXDelivery(t *testing.T) {
+	port, received := startSink(t)
+
+	rewriter, err := srs.New("0123456789abcdef", "srs.maskr.app")
+	assert.NoError(t, err)
+	delivery := mailer.NewMXDelivery("relay.maskr.app", rewriter)
+	delivery.Port = port
+	delivery.Resolver = fakeMXResolver{
+		"example.com": {{Host: "127.0.0.1.", Pref: 10}},
+	}
+
+	err = delivery.ForwardMail(context.Background(), &mailer.Message{
+		FromName:     "Alice",
+		From:         "mask@maskr.app",
+		To:           "user@example.com",
+		EnvelopeFrom: "alice@sender.example",
+		Subject:      "Hello",
+		Content:      mailer.Content{TextBody: "hello world"},
+	})
+	assert.NoError(t, err)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, []string{"user@example.com"}, data.To)
+		assert.True(t, strings.HasPrefix(data.From, "SRS0="))
+		original, err := rewriter.Reverse(data.From)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@sender.example", original)
+		assert.Contains(t, string(data.Data), "Subject: Hello")
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink did not receive the message")
+	}
+}
+
+func TestMXDeliveryNullMX(t *testing.T) {
+	rewriter, err := srs.New("0123456789abcdef", "srs.maskr.app")
+	assert.NoError(t, err)
+	delivery := mailer.NewMXDelivery("relay.maskr.app", rewriter)
+	delivery.Resolver = fakeMXResolver{
+		"example.com": {{Host: ".", Pref: 0}},
+	}
+	err = delivery.ForwardMail(context.Background(), &mailer.Message{To: "user@example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPRelay forwards mail through an authenticated SMTP smarthost.
+type SMTPRelay struct {
+	address       string
+	username      string
+	password      string
+	hostname      string
+	bounceAddress string
+}
+
+func NewSMTPRelay(address, username, password, hostname, bounceAddress string) *SMTPRelay {
+	return &SMTPRelay{
+		address:       address,
+		username:      username,
+		password:      password,
+		hostname:      hostname,
+		bounceAddress: bounceAddress,
+	}
+}
+
+func (r *SMTPRelay) ForwardMail(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(r.address)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Hello(r.hostname); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if r.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", r.username, r.password, host)); err != nil {
+			return err
+		}
+	}
+	bounceAddress := r.bounceAddress
+	if msg.BounceAddress != "" {
+		bounceAddress = msg.BounceAddress
+	}
+	if err := client.Mail(bounceAddress); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
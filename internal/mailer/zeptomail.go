@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ZeptoMail forwards mail through the ZeptoMail HTTP API.
+type ZeptoMail struct {
+	token         string
+	bounceAddress string
+	httpClient    *http.Client
+}
+
+func NewZeptoMail(token, bounceAddress string) *ZeptoMail {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	transport.MaxConnsPerHost = 100
+	transport.MaxIdleConnsPerHost = 100
+
+	return &ZeptoMail{
+		token:         token,
+		bounceAddress: bounceAddress,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+		}}
+}
+
+func (m *ZeptoMail) createEmailJSON(email string) []map[string]interface{} {
+	data := make([]map[string]interface{}, 0)
+	entry := map[string]interface{}{
+		"email_address": map[string]interface{}{
+			"address": email,
+		},
+	}
+	data = append(data, entry)
+	return data
+}
+
+// The API takes custom headers as an object, so only the first value of a repeated header is kept.
+func (m *ZeptoMail) createHeadersJSON(headers []Header) map[string]interface{} {
+	data := make(map[string]interface{})
+	for _, v := range headers {
+		if _, ok := data[v.Key]; !ok {
+			data[v.Key] = v.Value
+		}
+	}
+	return data
+}
+
+// ZeptoMail has no notion of alternative calendar parts or reports, so invitations and report parts are sent as regular attachments.
+func (m *ZeptoMail) createAttachmentsJSON(content Content) ([]map[string]interface{}, []map[string]interface{}) {
+	attachments := make([]map[string]interface{}, 0)
+	inlineImages := make([]map[string]interface{}, 0)
+	all := append([]Attachment{}, content.Attachments...)
+	if content.Calendar != nil {
+		all = append(all, *content.Calendar)
+	}
+	if content.Report != nil {
+		all = append(all, content.Report.Parts...)
+	}
+	for _, v := range all {
+		entry := map[string]interface{}{
+			"content":   base64.StdEncoding.EncodeToString(v.Data),
+			"mime_type": v.ContentType,
+		}
+		if v.isInline() {
+			entry["cid"] = v.ContentID
+			inlineImages = append(inlineImages, entry)
+			continue
+		}
+		entry["name"] = v.Filename
+		attachments = append(attachments, entry)
+	}
+	return attachments, inlineImages
+}
+
+func (m *ZeptoMail) ForwardMail(ctx context.Context, msg *Message) error {
+	bounceAddress := m.bounceAddress
+	if msg.BounceAddress != "" {
+		bounceAddress = msg.BounceAddress
+	}
+	body := map[string]interface{}{
+		"bounce_address": bounceAddress,
+		"htmlbody":       msg.HTMLBody,
+		"textbody":       msg.TextBody,
+		"subject":        msg.Subject,
+		"from": map[string]interface{}{
+			"address": msg.From,
+			"name":    msg.FromName,
+		},
+		"to": m.createEmailJSON(msg.To),
+	}
+	if msg.ReplyTo != "" {
+		body["reply_to"] = []map[string]interface{}{
+			{"address": msg.ReplyTo, "name": msg.FromName},
+		}
+	}
+	if len(msg.Headers) > 0 {
+		body["mime_headers"] = m.createHeadersJSON(msg.Headers)
+	}
+	attachments, inlineImages := m.createAttachmentsJSON(msg.Content)
+	if len(attachments) > 0 {
+		body["attachments"] = attachments
+	}
+	if len(inlineImages) > 0 {
+		body["inline_images"] = inlineImages
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", "https://api.zeptomail.eu/v1.1/email", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+
+	}
+	authHeader := fmt.Sprintf("Zoho-enczapikey %v", m.token)
+	request.Header = map[string][]string{
+		"Accept":        {"application/json"},
+		"Content-Type":  {"application/json"},
+		"Authorization": {authHeader},
+	}
+	resp, err := m.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != 201 {
+		errorMessage := fmt.Sprintf("expected status code 201, got: %v with response body: %v", resp.StatusCode, res)
+		// Authentication and rate limit failures are on our side and may go away, other client errors will not.
+		switch resp.StatusCode {
+		case 401, 403, 408, 429:
+		default:
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return &PermanentError{Err: errors.New(errorMessage)}
+			}
+		}
+		return errors.New(errorMessage)
+	}
+	return err
+}
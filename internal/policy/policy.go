@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/mailer"
+)
+
+// Action is what happens to a message after the checks ran.
+type Action string
+
+const (
+	Accept Action = "accept"
+	// Tag delivers the message with headers describing its score.
+	Tag Action = "tag"
+	// Quarantine delivers the message marked as spam.
+	Quarantine Action = "quarantine"
+	// Tempfail asks the sender to try again later.
+	Tempfail Action = "tempfail"
+	Reject   Action = "reject"
+)
+
+// Policy maps the weighted sum of the symbols of all checks to an action.
+type Policy struct {
+	TagScore        float64
+	QuarantineScore float64
+	TempfailScore   float64
+	RejectScore     float64
+	// Weights multiply the scores of the symbols of a check, by check name. Checks without a weight count once.
+	Weights map[string]float64
+}
+
+// ScoredSymbol is a symbol with its weight applied.
+type ScoredSymbol struct {
+	Check    string
+	Name     string
+	Score    float64
+	Tempfail bool
+}
+
+func (s ScoredSymbol) String() string {
+	return fmt.Sprintf("%v(%.2f)", s.Name, s.Score)
+}
+
+type Verdict struct {
+	Action  Action
+	Score   float64
+	Symbols []ScoredSymbol
+}
+
+// Reason describes why the verdict was reached.
+func (v Verdict) Reason() string {
+	symbols := make([]string, 0, len(v.Symbols))
+	for _, s := range v.Symbols {
+		if s.Score != 0 {
+			symbols = append(symbols, s.String())
+		}
+	}
+	return fmt.Sprintf("%v with score %.2f: %v", v.Action, v.Score, strings.Join(symbols, ", "))
+}
+
+// Headers describe the verdict to the recipient, so their filters can act on it.
+func (v Verdict) Headers() []mailer.Header {
+	symbols := make([]string, 0, len(v.Symbols))
+	for _, s := range v.Symbols {
+		symbols = append(symbols, s.String())
+	}
+	return []mailer.Header{
+		{Key: "X-Maskr-Spam-Action", Value: string(v.Action)},
+		{Key: "X-Maskr-Spam-Score", Value: fmt.Sprintf("%.2f", v.Score)},
+		{Key: "X-Maskr-Spam-Symbols", Value: strings.Join(symbols, ", ")},
+	}
+}
+
+// Evaluate weighs the symbols, keyed by the name of the check that emitted them.
+func (p *Policy) Evaluate(symbols map[string][]check.Symbol) Verdict {
+	verdict := Verdict{}
+	for name, list := range symbols {
+		weight, ok := p.Weights[name]
+		if !ok {
+			weight = 1
+		}
+		for _, s := range list {
+			scored := ScoredSymbol{Check: name, Name: s.Name, Score: s.Score * weight, Tempfail: s.Tempfail}
+			verdict.Symbols = append(verdict.Symbols, scored)
+			verdict.Score += scored.Score
+		}
+	}
+	// Highest scores first, so the reason starts with what mattered most.
+	sort.SliceStable(verdict.Symbols, func(i, j int) bool {
+		if verdict.Symbols[i].Score != verdict.Symbols[j].Score {
+			return verdict.Symbols[i].Score > verdict.Symbols[j].Score
+		}
+		return verdict.Symbols[i].Name < verdict.Symbols[j].Name
+	})
+	switch {
+	case verdict.Score >= p.RejectScore:
+		verdict.Action = Reject
+	case verdict.Score >= p.TempfailScore || verdict.tempfail():
+		verdict.Action = Tempfail
+	case verdict.Score >= p.QuarantineScore:
+		verdict.Action = Quarantine
+	case verdict.Score >= p.TagScore:
+		verdict.Action = Tag
+	default:
+		verdict.Action = Accept
+	}
+	return verdict
+}
+
+// tempfail reports whether a check asked to try again later. Only a score high enough to reject the message anyway
+// overrides that.
+func (v Verdict) tempfail() bool {
+	for _, s := range v.Symbols {
+		if s.Tempfail {
+			return true
+		}
+	}
+	return false
+}
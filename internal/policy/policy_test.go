@@ -0,0 +1,52 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate(t *testing.T) {
+	p := &policy.Policy{TagScore: 4, QuarantineScore: 6, TempfailScore: 12, RejectScore: 15}
+
+	verdict := p.Evaluate(map[string][]check.Symbol{
+		"spf":  {{Name: "SPF_PASS", Score: 0}},
+		"dkim": {{Name: "DKIM_PASS", Score: 0}},
+	})
+	assert.Equal(t, policy.Accept, verdict.Action)
+
+	verdict = p.Evaluate(map[string][]check.Symbol{
+		"spf":        {{Name: "SPF_FAIL", Score: 3}},
+		"reversedns": {{Name: "RDNS_NONE", Score: 3}},
+	})
+	assert.Equal(t, policy.Quarantine, verdict.Action)
+	assert.Equal(t, 6.0, verdict.Score)
+
+	verdict = p.Evaluate(map[string][]check.Symbol{
+		"dmarc":     {{Name: "DMARC_POLICY_REJECT", Score: 15}},
+		"blacklist": {{Name: "RBL_LISTED", Score: 8}},
+	})
+	assert.Equal(t, policy.Reject, verdict.Action)
+	assert.Equal(t, "DMARC_POLICY_REJECT", verdict.Symbols[0].Name, "highest score first")
+
+	tempfail := map[string][]check.Symbol{"dmarc": {{Name: "DMARC_TEMPFAIL", Score: 0, Tempfail: true}}}
+	assert.Equal(t, policy.Tempfail, p.Evaluate(tempfail).Action)
+	tempfail["blacklist"] = []check.Symbol{{Name: "RBL_LISTED", Score: 16}}
+	assert.Equal(t, policy.Reject, p.Evaluate(tempfail).Action)
+}
+
+func TestWeights(t *testing.T) {
+	p := &policy.Policy{TagScore: 4, QuarantineScore: 6, TempfailScore: 12, RejectScore: 15, Weights: map[string]float64{"blacklist": 0.5}}
+	verdict := p.Evaluate(map[string][]check.Symbol{
+		"blacklist": {{Name: "RBL_LISTED", Score: 8}},
+		"spf":       {{Name: "SPF_FAIL", Score: 3}},
+	})
+	assert.Equal(t, 7.0, verdict.Score)
+	assert.Equal(t, policy.Quarantine, verdict.Action)
+
+	p.Weights["blacklist"] = 0
+	assert.Equal(t, policy.Accept, p.Evaluate(map[string][]check.Symbol{"blacklist": {{Name: "RBL_LISTED", Score: 8}}}).Action)
+
+}
@@ -0,0 +1,297 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	mathrand "math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const keyPrefix = "queue/"
+
+// Entry is a message waiting for delivery.
+type Entry struct {
+	ID          string
+	Message     *mailer.Message
+	Attempts    int
+	CreatedAt   time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+type Options struct {
+	Workers int
+	// Lifetime is how long delivery is retried before the message is given up on.
+	Lifetime   time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Queue persists forwarded mail in the store and delivers it in the background, retrying with exponential backoff.
+// It implements mailer.Forwarder, so it can be put in front of any delivery backend.
+type Queue struct {
+	store     store.Store
+	forwarder mailer.Forwarder
+	options   Options
+	wake      chan struct{}
+	inFlight  map[string]bool
+	// schedule holds the next attempt of every queued message, so only the messages that are due are read from
+	// the store. It is filled from the store when Run starts and kept up to date by save and remove.
+	schedule map[string]time.Time
+	mutex    sync.Mutex
+
+	// OnDelivered is called after a message has been delivered.
+	OnDelivered func(entry *Entry)
+	// OnFailed is called when a message is given up on, either because of a permanent error or because its lifetime expired.
+	OnFailed func(entry *Entry, err error)
+}
+
+func New(s store.Store, forwarder mailer.Forwarder, options Options) *Queue {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	return &Queue{
+		store:     s,
+		forwarder: forwarder,
+		options:   options,
+		wake:      make(chan struct{}, 1),
+		inFlight:  make(map[string]bool),
+		schedule:  make(map[string]time.Time),
+	}
+}
+
+// ForwardMail accepts msg into the queue. Once it returns, the message survives restarts.
+func (q *Queue) ForwardMail(ctx context.Context, msg *mailer.Message) error {
+	id, err := generateId()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := &Entry{
+		ID:          id,
+		Message:     msg,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	if err := q.save(entry); err != nil {
+		return err
+	}
+	logrus.Debugf("queued message %v for %v", id, msg.To)
+	q.notify()
+	return nil
+}
+
+// Run delivers queued messages until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context) {
+	q.loadSchedule()
+	jobs := make(chan *Entry)
+	wg := sync.WaitGroup{}
+	wg.Add(q.options.Workers)
+	for i := 0; i < q.options.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				q.attempt(ctx, entry)
+				q.mutex.Lock()
+				delete(q.inFlight, entry.ID)
+				q.mutex.Unlock()
+				q.notify()
+			}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := q.dispatch(ctx, jobs)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case <-ctx.Done():
+			close(jobs)
+			wg.Wait()
+			return
+		case <-timer.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loadSchedule adds the messages that were queued before a restart to the schedule.
+func (q *Queue) loadSchedule() {
+	keys, err := q.store.Keys(keyPrefix)
+	if err != nil {
+		logrus.Errorf("queue error: %v", err)
+		return
+	}
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, keyPrefix)
+		entry, err := q.load(id)
+		if err != nil {
+			logrus.Errorf("error loading queued message %v: %v", id, err)
+			continue
+		}
+		q.mutex.Lock()
+		if _, ok := q.schedule[id]; !ok {
+			q.schedule[id] = entry.NextAttempt
+		}
+		q.mutex.Unlock()
+	}
+	logrus.Infof("loaded %v queued message(s)", len(keys))
+}
+
+// dispatch hands every entry that is due and not already being delivered to the workers, in order of arrival.
+// It returns when the queue should be looked at again.
+func (q *Queue) dispatch(ctx context.Context, jobs chan<- *Entry) time.Time {
+	now := time.Now()
+	next := now.Add(time.Minute)
+	var due []string
+	q.mutex.Lock()
+	for id, attempt := range q.schedule {
+		if q.inFlight[id] {
+			continue
+		}
+		if attempt.After(now) {
+			if attempt.Before(next) {
+				next = attempt
+			}
+			continue
+		}
+		due = append(due, id)
+	}
+	q.mutex.Unlock()
+	sort.Strings(due)
+	for _, id := range due {
+		entry, err := q.load(id)
+		if err != nil {
+			// The entry stays in the store to be looked at, but is not tried again until a restart.
+			logrus.Errorf("error loading queued message %v: %v", id, err)
+			q.mutex.Lock()
+			delete(q.schedule, id)
+			q.mutex.Unlock()
+			continue
+		}
+		q.mutex.Lock()
+		q.inFlight[id] = true
+		q.mutex.Unlock()
+		select {
+		case jobs <- entry:
+		case <-ctx.Done():
+			return next
+		}
+	}
+	return next
+}
+
+func (q *Queue) attempt(ctx context.Context, entry *Entry) {
+	deliveryCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	err := q.forwarder.ForwardMail(deliveryCtx, entry.Message)
+	cancel()
+	if err == nil {
+		logrus.Debugf("delivered queued message %v to %v after %v attempt(s)", entry.ID, entry.Message.To, entry.Attempts+1)
+		q.remove(entry)
+		if q.OnDelivered != nil {
+			q.OnDelivered(entry)
+		}
+		return
+	}
+	// Shutting down is not the message's fault, try again after the restart.
+	if ctx.Err() != nil {
+		return
+	}
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if mailer.IsPermanent(err) || time.Since(entry.CreatedAt) >= q.options.Lifetime {
+		logrus.Infof("giving up on queued message %v to %v after %v attempt(s): %v", entry.ID, entry.Message.To, entry.Attempts, err)
+		q.remove(entry)
+		if q.OnFailed != nil {
+			q.OnFailed(entry, err)
+		}
+		return
+	}
+	entry.NextAttempt = time.Now().Add(q.backoff(entry.Attempts))
+	logrus.Infof("delivery of queued message %v to %v failed, retrying at %v: %v", entry.ID, entry.Message.To, entry.NextAttempt.Format(time.RFC3339), err)
+	if err := q.save(entry); err != nil {
+		logrus.Errorf("error saving queued message %v: %v", entry.ID, err)
+	}
+}
+
+// backoff doubles the delay after every attempt, with up to 10% jitter so retries of a burst spread out.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := float64(q.options.MinBackoff) * math.Pow(2, float64(attempts-1))
+	if delay > float64(q.options.MaxBackoff) {
+		delay = float64(q.options.MaxBackoff)
+	}
+	delay += delay * 0.1 * mathrand.Float64()
+	return time.Duration(delay)
+}
+
+func (q *Queue) save(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := q.store.Put(keyPrefix+entry.ID, data); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	q.schedule[entry.ID] = entry.NextAttempt
+	q.mutex.Unlock()
+	return nil
+}
+
+func (q *Queue) load(id string) (*Entry, error) {
+	data, err := q.store.Get(keyPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	if entry.Message == nil {
+		return nil, errors.New("queued entry has no message")
+	}
+	return entry, nil
+}
+
+func (q *Queue) remove(entry *Entry) {
+	q.mutex.Lock()
+	delete(q.schedule, entry.ID)
+	q.mutex.Unlock()
+	if err := q.store.Delete(keyPrefix + entry.ID); err != nil {
+		logrus.Errorf("error removing queued message %v: %v", entry.ID, err)
+	}
+}
+
+// Queue IDs start with the time of creation, so the store lists them in order of arrival.
+func generateId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102150405") + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,150 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/queue"
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyForwarder fails the first failures deliveries with err.
+type flakyForwarder struct {
+	failures int32
+	attempts int32
+	err      error
+}
+
+func (f *flakyForwarder) ForwardMail(ctx context.Context, msg *mailer.Message) error {
+	if atomic.AddInt32(&f.attempts, 1) <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+var options = queue.Options{
+	Workers:    2,
+	Lifetime:   time.Hour,
+	MinBackoff: time.Millisecond,
+	MaxBackoff: time.Millisecond,
+}
+
+func run(t *testing.T, q *queue.Queue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go q.Run(ctx)
+}
+
+func TestQueueRetries(t *testing.T) {
+	forwarder := &flakyForwarder{failures: 2, err: errors.New("connection refused")}
+	q := queue.New(store.NewMemoryStore(), forwarder, options)
+	delivered := make(chan *queue.Entry, 1)
+	q.OnDelivered = func(entry *queue.Entry) { delivered <- entry }
+	run(t, q)
+
+	assert.NoError(t, q.ForwardMail(context.Background(), &mailer.Message{To: "user@example.com"}))
+	select {
+	case entry := <-delivered:
+		assert.Equal(t, 2, entry.Attempts)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&forwarder.attempts))
+	case <-time.After(30 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestQueuePermanentFailure(t *testing.T) {
+	forwarder := &flakyForwarder{failures: 1, err: &mailer.PermanentError{Err: errors.New("no such user")}}
+	s := store.NewMemoryStore()
+	q := queue.New(s, forwarder, options)
+	failed := make(chan error, 1)
+	q.OnFailed = func(entry *queue.Entry, err error) { failed <- err }
+	run(t, q)
+
+	assert.NoError(t, q.ForwardMail(context.Background(), &mailer.Message{To: "user@example.com"}))
+	select {
+	case err := <-failed:
+		assert.True(t, mailer.IsPermanent(err))
+		keys, _ := s.Keys("")
+		assert.Empty(t, keys)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not given up on")
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	s, err := store.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	stopped := queue.New(s, &flakyForwarder{}, options)
+	assert.NoError(t, stopped.ForwardMail(context.Background(), &mailer.Message{To: "user@example.com"}))
+
+	q := queue.New(s, &flakyForwarder{}, options)
+	delivered := make(chan *queue.Entry, 1)
+	q.OnDelivered = func(entry *queue.Entry) { delivered <- entry }
+	run(t, q)
+	select {
+	case entry := <-delivered:
+		assert.Equal(t, "user@example.com", entry.Message.To)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message queued before the restart was not delivered")
+	}
+}
+
+// countingStore counts the reads of the store.
+type countingStore struct {
+	store.Store
+	gets, keys int32
+}
+
+func (s *countingStore) Get(key string) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(key)
+}
+
+func (s *countingStore) Keys(prefix string) ([]string, error) {
+	atomic.AddInt32(&s.keys, 1)
+	return s.Store.Keys(prefix)
+}
+
+// refusingForwarder fails every delivery to the address to.
+type refusingForwarder struct {
+	to string
+}
+
+func (f *refusingForwarder) ForwardMail(ctx context.Context, msg *mailer.Message) error {
+	if msg.To == f.to {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestQueueReadsOnlyDueMessages(t *testing.T) {
+	s := &countingStore{Store: store.NewMemoryStore()}
+	slow := options
+	slow.MinBackoff, slow.MaxBackoff = time.Hour, time.Hour
+	q := queue.New(s, &refusingForwarder{to: "waiting@example.com"}, slow)
+	delivered := make(chan *queue.Entry, 1)
+	q.OnDelivered = func(entry *queue.Entry) { delivered <- entry }
+
+	// Both are read when the queue starts and when they are first due, after that the waiting one is left alone.
+	assert.NoError(t, q.ForwardMail(context.Background(), &mailer.Message{To: "waiting@example.com"}))
+	assert.NoError(t, q.ForwardMail(context.Background(), &mailer.Message{To: "first@example.com"}))
+	run(t, q)
+	expectDelivery := func(to string) {
+		select {
+		case entry := <-delivered:
+			assert.Equal(t, to, entry.Message.To)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+	}
+	expectDelivery("first@example.com")
+	assert.NoError(t, q.ForwardMail(context.Background(), &mailer.Message{To: "second@example.com"}))
+	expectDelivery("second@example.com")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.keys), "the store is listed once, at startup")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&s.gets))
+}
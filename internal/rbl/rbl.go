@@ -2,16 +2,32 @@ package rbl
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/maskrapp/relay/internal/global"
 )
 
-func CreateRBL(ctx global.Context) []string {
-	return []string{
-		"bl.spamcop.net",
-		"psbl.surriel.com",
-		"ubl.unsubscore.com",
-		"b.barracudacentral.org",
-		fmt.Sprintf("%v.sbl-xbl.dq.spamhaus.net", ctx.Config().SpamhausToken),
+// List is a DNSBL zone (RFC 5782), with the address families it lists.
+type List struct {
+	Zone string
+	IPv4 bool
+	IPv6 bool
+}
+
+// Covers reports whether the list can be asked about ip.
+func (l List) Covers(ip net.IP) bool {
+	if ip.To4() != nil {
+		return l.IPv4
+	}
+	return l.IPv6
+}
+
+func CreateRBL(ctx global.Context) []List {
+	return []List{
+		{Zone: "bl.spamcop.net", IPv4: true},
+		{Zone: "psbl.surriel.com", IPv4: true},
+		{Zone: "ubl.unsubscore.com", IPv4: true},
+		{Zone: "b.barracudacentral.org", IPv4: true},
+		{Zone: fmt.Sprintf("%v.sbl-xbl.dq.spamhaus.net", ctx.Config().SpamhausToken), IPv4: true, IPv6: true},
 	}
 }
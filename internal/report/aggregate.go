@@ -0,0 +1,308 @@
+package report
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/store"
+)
+
+const aggregatePrefix = "dmarc-aggregate/"
+
+// Evaluation is the outcome of DMARC for one message.
+type Evaluation struct {
+	SourceIP     net.IP
+	HeaderFrom   string
+	EnvelopeFrom string
+	// Disposition is what happened to the message: none, quarantine or reject.
+	Disposition dmarc.Policy
+	Auth        check.AuthResults
+}
+
+// Aggregate collects the evaluations for one policy domain during one reporting period.
+type Aggregate struct {
+	Domain string
+	Begin  time.Time
+	End    time.Time
+	// RUA are the addresses the domain owner wants the report at.
+	RUA       []string
+	Published PolicyPublished
+	Records   []Record
+}
+
+// The types below follow the XML schema of RFC 7489 appendix C.
+
+type Feedback struct {
+	XMLName   xml.Name        `xml:"feedback"`
+	Version   string          `xml:"version"`
+	Metadata  ReportMetadata  `xml:"report_metadata"`
+	Published PolicyPublished `xml:"policy_published"`
+	Records   []Record        `xml:"record"`
+}
+
+type ReportMetadata struct {
+	OrgName   string    `xml:"org_name"`
+	Email     string    `xml:"email"`
+	ReportID  string    `xml:"report_id"`
+	DateRange DateRange `xml:"date_range"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain string `xml:"domain"`
+	ADKIM  string `xml:"adkim,omitempty"`
+	ASPF   string `xml:"aspf,omitempty"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp,omitempty"`
+	Pct    int    `xml:"pct"`
+}
+
+type Record struct {
+	Row         Row         `xml:"row"`
+	Identifiers Identifiers `xml:"identifiers"`
+	AuthResults AuthResults `xml:"auth_results"`
+}
+
+type Row struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition string         `xml:"disposition"`
+	DKIM        string         `xml:"dkim"`
+	SPF         string         `xml:"spf"`
+	Reasons     []PolicyReason `xml:"reason,omitempty"`
+}
+
+type PolicyReason struct {
+	Type string `xml:"type"`
+}
+
+type Identifiers struct {
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type AuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty"`
+	SPF  []SPFAuthResult  `xml:"spf"`
+}
+
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// Aggregator keeps the evaluations of every reporting period in the store until they are reported.
+type Aggregator struct {
+	store  store.Store
+	period time.Duration
+	mutex  sync.Mutex
+}
+
+// NewAggregator creates an aggregator for reporting periods of the given length, aligned to UTC.
+func NewAggregator(s store.Store, period time.Duration) *Aggregator {
+	return &Aggregator{store: s, period: period}
+}
+
+// Record adds an evaluation to the aggregate of its policy domain, if the domain asks for aggregate reports.
+func (a *Aggregator) Record(ev Evaluation, now time.Time) error {
+	result := ev.Auth.DMARC
+	if result == nil || result.Record == nil || len(result.Record.ReportURIAggregate) == 0 {
+		return nil
+	}
+	begin := now.UTC().Truncate(a.period)
+	key := aggregatePrefix + strconv.FormatInt(begin.Unix(), 10) + "/" + result.PolicyDomain
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	aggregate, err := a.load(key)
+	if errors.Is(err, store.ErrNotFound) {
+		aggregate = &Aggregate{
+			Domain:    result.PolicyDomain,
+			Begin:     begin,
+			End:       begin.Add(a.period),
+			RUA:       result.Record.ReportURIAggregate,
+			Published: published(result.PolicyDomain, result.Record),
+		}
+	} else if err != nil {
+		return err
+	}
+	record := newRecord(ev)
+	found := false
+	for i, v := range aggregate.Records {
+		count := v.Row.Count
+		v.Row.Count = record.Row.Count
+		if reflect.DeepEqual(v, record) {
+			aggregate.Records[i].Row.Count = count + 1
+			found = true
+			break
+		}
+	}
+	if !found {
+		aggregate.Records = append(aggregate.Records, record)
+	}
+	data, err := json.Marshal(aggregate)
+	if err != nil {
+		return err
+	}
+	return a.store.Put(key, data)
+}
+
+// Due returns the keys of the aggregates whose period ended before now.
+func (a *Aggregator) Due(now time.Time) ([]string, error) {
+	keys, err := a.store.Keys(aggregatePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var due []string
+	for _, key := range keys {
+		begin, _, _ := strings.Cut(strings.TrimPrefix(key, aggregatePrefix), "/")
+		unix, err := strconv.ParseInt(begin, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !time.Unix(unix, 0).Add(a.period).After(now) {
+			due = append(due, key)
+		}
+	}
+	return due, nil
+}
+
+// Load returns the aggregate stored at key.
+func (a *Aggregator) Load(key string) (*Aggregate, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.load(key)
+}
+
+func (a *Aggregator) load(key string) (*Aggregate, error) {
+	data, err := a.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	aggregate := &Aggregate{}
+	return aggregate, json.Unmarshal(data, aggregate)
+}
+
+// Remove deletes the aggregate at key once it was reported.
+func (a *Aggregator) Remove(key string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.store.Delete(key)
+}
+
+// Feedback turns the aggregate into a report submitted by orgName, with email as its contact.
+func (agg *Aggregate) Feedback(orgName, email string) (*Feedback, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &Feedback{
+		Version: "1.0",
+		Metadata: ReportMetadata{
+			OrgName:   orgName,
+			Email:     email,
+			ReportID:  fmt.Sprintf("%v.%v", agg.Begin.Unix(), hex.EncodeToString(b)),
+			DateRange: DateRange{Begin: agg.Begin.Unix(), End: agg.End.Unix() - 1},
+		},
+		Published: agg.Published,
+		Records:   agg.Records,
+	}, nil
+}
+
+func published(domain string, record *dmarc.Record) PolicyPublished {
+	pct := 100
+	if record.Percent != nil {
+		pct = *record.Percent
+	}
+	return PolicyPublished{
+		Domain: domain,
+		ADKIM:  string(record.DKIMAlignment),
+		ASPF:   string(record.SPFAlignment),
+		P:      string(record.Policy),
+		SP:     string(record.SubdomainPolicy),
+		Pct:    pct,
+	}
+}
+
+func newRecord(ev Evaluation) Record {
+	result := ev.Auth.DMARC
+	evaluated := PolicyEvaluated{
+		Disposition: string(ev.Disposition),
+		DKIM:        passOrFail(result.DKIMAligned),
+		SPF:         passOrFail(result.SPFAligned),
+	}
+	expected := result.Policy
+	if result.Value == authres.ResultPass {
+		expected = dmarc.PolicyNone
+	}
+	switch {
+	case result.Reason != "":
+		evaluated.Reasons = []PolicyReason{{Type: result.Reason}}
+	case ev.Disposition != expected:
+		// Our own checks decided differently than the DMARC policy alone would have.
+		evaluated.Reasons = []PolicyReason{{Type: "local_policy"}}
+	}
+
+	record := Record{
+		Row: Row{SourceIP: ev.SourceIP.String(), Count: 1, PolicyEvaluated: evaluated},
+		Identifiers: Identifiers{
+			EnvelopeFrom: domainOf(ev.EnvelopeFrom),
+			HeaderFrom:   result.From,
+		},
+	}
+	if ev.Auth.DKIM != nil {
+		for _, v := range ev.Auth.DKIM.Signatures {
+			record.AuthResults.DKIM = append(record.AuthResults.DKIM, DKIMAuthResult{Domain: v.Domain, Selector: v.Selector, Result: string(v.Value)})
+		}
+	}
+	if spf := ev.Auth.SPF; spf != nil {
+		scope := "mfrom"
+		if domainOf(spf.MailFrom) == "" {
+			scope = "helo"
+		}
+		record.AuthResults.SPF = []SPFAuthResult{{Domain: spf.Domain(), Scope: scope, Result: string(spf.Value)}}
+	}
+	return record
+}
+
+func passOrFail(pass bool) string {
+	if pass {
+		return "pass"
+	}
+	return "fail"
+}
+
+func domainOf(address string) string {
+	if _, domain, ok := strings.Cut(address, "@"); ok {
+		return strings.ToLower(domain)
+	}
+	return ""
+}
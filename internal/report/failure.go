@@ -0,0 +1,268 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "redacted"
+
+// Redaction decides what of the original header ends up in a failure report (RFC 6590).
+type Redaction struct {
+	// Fields are header fields whose values are left out.
+	Fields []string
+	// Recipients replaces the local part of the recipient, the mask address, wherever it appears.
+	Recipients bool
+}
+
+// Failure is a message that failed DMARC.
+type Failure struct {
+	Evaluation
+	// Recipient is the envelope recipient of the message.
+	Recipient string
+	Arrival   time.Time
+	// Message is the message as received, only its header section is reported.
+	Message []byte
+}
+
+// FailureLimits bound the failure reports, so forged mail cannot turn the relay into a source of unwanted reports
+// (RFC 7489 section 7.3).
+type FailureLimits struct {
+	// PerDomain and PerAddress are the reports sent about one policy domain and to one ruf= address in every
+	// Interval, zero for no limit.
+	PerDomain  int
+	PerAddress int
+	Interval   time.Duration
+	// Queue is the number of failures waiting to be reported, beyond which new ones are dropped.
+	Queue int
+}
+
+// FailureReporter sends authentication failure reports (RFC 6591) to the ruf= addresses of a domain.
+type FailureReporter struct {
+	forwarder mailer.Forwarder
+	// Resolver verifies report addresses outside the policy domain, resolver.Default when nil.
+	Resolver  resolver.Resolver
+	from      string
+	orgName   string
+	hostname  string
+	redaction Redaction
+	queue     chan Failure
+	domains   *rateLimiter
+	addresses *rateLimiter
+}
+
+// NewFailureReporter creates a reporter that sends the reports from the address from, for the relay at hostname.
+func NewFailureReporter(forwarder mailer.Forwarder, from, orgName, hostname string, redaction Redaction, limits FailureLimits) *FailureReporter {
+	return &FailureReporter{
+		forwarder: forwarder,
+		from:      from,
+		orgName:   orgName,
+		hostname:  hostname,
+		redaction: redaction,
+		queue:     make(chan Failure, limits.Queue),
+		domains:   newRateLimiter(limits.PerDomain, limits.Interval),
+		addresses: newRateLimiter(limits.PerAddress, limits.Interval),
+	}
+}
+
+// Enqueue hands a failure to Run without waiting for it to be reported. It reports false when the failure is dropped,
+// because its domain had its share of reports or the queue is full.
+func (r *FailureReporter) Enqueue(failure Failure) bool {
+	if !r.domains.allow(strings.ToLower(failure.Auth.DMARC.PolicyDomain), time.Now()) {
+		logrus.Debugf("dropping DMARC failure report for %v: rate limit reached", failure.Auth.DMARC.PolicyDomain)
+		return false
+	}
+	select {
+	case r.queue <- failure:
+		return true
+	default:
+		logrus.Warnf("dropping DMARC failure report for %v: queue is full", failure.Auth.DMARC.PolicyDomain)
+		return false
+	}
+}
+
+// Run reports the enqueued failures one at a time until ctx is cancelled.
+func (r *FailureReporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case failure := <-r.queue:
+			if err := r.Report(ctx, failure); err != nil {
+				logrus.Errorf("error sending DMARC failure report: %v", err)
+			}
+		}
+	}
+}
+
+// WantsReport reports whether the domain asked for a failure report on a message with these results:
+// it failed DMARC with a quarantine or reject policy, in a way the fo= tag of the record selects (RFC 7489 section 6.3).
+func WantsReport(auth check.AuthResults) bool {
+	result := auth.DMARC
+	if result == nil || result.Record == nil || len(result.Record.ReportURIFailure) == 0 {
+		return false
+	}
+	if result.Value != authres.ResultFail || (result.Policy != dmarc.PolicyQuarantine && result.Policy != dmarc.PolicyReject) {
+		return false
+	}
+	options := result.Record.FailureOptions
+	if options == 0 {
+		options = dmarc.FailureAll
+	}
+	// A DMARC fail means no identifier is aligned and passing, which satisfies both fo=0 and fo=1.
+	if options&(dmarc.FailureAll|dmarc.FailureAny) != 0 {
+		return true
+	}
+	if options&dmarc.FailureSPF != 0 && auth.SPF != nil && auth.SPF.Value != authres.ResultPass {
+		return true
+	}
+	if options&dmarc.FailureDKIM != 0 && auth.DKIM != nil {
+		for _, v := range auth.DKIM.Signatures {
+			if v.Value != authres.ResultPass {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report queues a failure report to every ruf= address of the domain that accepts it and did not reach its limit.
+func (r *FailureReporter) Report(ctx context.Context, failure Failure) error {
+	result := failure.Auth.DMARC
+	header := r.redact(failure.Message, failure.Recipient)
+	// An address that cannot be reached does not keep the report from the others.
+	var failed []string
+	for _, uri := range result.Record.ReportURIFailure {
+		to, limit, err := parseReportURI(uri)
+		if err != nil {
+			logrus.Debugf("skipping DMARC failure report URI %v of %v: %v", uri, result.PolicyDomain, err)
+			continue
+		}
+		if limit > 0 && int64(len(header)) > limit {
+			continue
+		}
+		if !verifyDestination(ctx, r.Resolver, result.PolicyDomain, to) {
+			logrus.Debugf("%v did not agree to receive DMARC reports for %v", to, result.PolicyDomain)
+			continue
+		}
+		if !r.addresses.allow(strings.ToLower(to), time.Now()) {
+			logrus.Debugf("skipping DMARC failure report to %v: rate limit reached", to)
+			continue
+		}
+		err = r.forwarder.ForwardMail(ctx, &mailer.Message{
+			FromName: r.orgName,
+			From:     r.from,
+			To:       to,
+			Subject:  fmt.Sprintf("DMARC failure report for %v", result.From),
+			System:   true,
+			Headers: []mailer.Header{
+				{Key: "Auto-Submitted", Value: "auto-generated"},
+			},
+			Content: mailer.Content{
+				TextBody: fmt.Sprintf("This is an authentication failure report for a message from %v [%v], received by %v.\r\n", result.From, failure.SourceIP, r.hostname),
+				Report: &mailer.Report{
+					Type: "feedback-report",
+					Parts: []mailer.Attachment{
+						{ContentType: "message/feedback-report", Data: r.feedbackReport(failure)},
+						{ContentType: "text/rfc822-headers", Data: header},
+					},
+				},
+			},
+		})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", to, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// feedbackReport renders the machine readable part of the report (RFC 5965 section 3.1, RFC 6591 section 3.1).
+func (r *FailureReporter) feedbackReport(failure Failure) []byte {
+	result := failure.Auth.DMARC
+	var alignment []string
+	if result.DKIMAligned {
+		alignment = append(alignment, "dkim")
+	}
+	if result.SPFAligned {
+		alignment = append(alignment, "spf")
+	}
+	if len(alignment) == 0 {
+		alignment = append(alignment, "none")
+	}
+	deliveryResult := "delivered"
+	switch failure.Disposition {
+	case dmarc.PolicyQuarantine:
+		deliveryResult = "spam"
+	case dmarc.PolicyReject:
+		deliveryResult = "reject"
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Feedback-Type: auth-failure\r\n")
+	fmt.Fprintf(buf, "User-Agent: maskr-relay/1.0\r\n")
+	fmt.Fprintf(buf, "Version: 1\r\n")
+	if failure.EnvelopeFrom != "" {
+		fmt.Fprintf(buf, "Original-Mail-From: <%v>\r\n", failure.EnvelopeFrom)
+	}
+	fmt.Fprintf(buf, "Arrival-Date: %v\r\n", failure.Arrival.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Source-IP: %v\r\n", failure.SourceIP)
+	fmt.Fprintf(buf, "Reported-Domain: %v\r\n", result.From)
+	fmt.Fprintf(buf, "Authentication-Results: %v\r\n", authres.Format(r.hostname, failure.Auth.Results()))
+	fmt.Fprintf(buf, "Auth-Failure: dmarc\r\n")
+	fmt.Fprintf(buf, "Delivery-Result: %v\r\n", deliveryResult)
+	fmt.Fprintf(buf, "Identity-Alignment: %v\r\n", strings.Join(alignment, ", "))
+	return buf.Bytes()
+}
+
+// redact applies the redaction rules to the header section of the original message.
+func (r *FailureReporter) redact(message []byte, recipient string) []byte {
+	fields := make(map[string]bool)
+	for _, v := range r.redaction.Fields {
+		fields[strings.ToLower(v)] = true
+	}
+	var recipientPattern *regexp.Regexp
+	if local, _, ok := strings.Cut(recipient, "@"); ok && r.redaction.Recipients {
+		recipientPattern = regexp.MustCompile(`(?i)(^|[^a-z0-9.!#$%&'*+/=?^_{|}~-])` + regexp.QuoteMeta(local) + `@`)
+	}
+	header := message
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i != -1 {
+		header = message[:i+2]
+	}
+	buf := &bytes.Buffer{}
+	skipping := false
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		continued := line[0] == ' ' || line[0] == '\t'
+		if !continued {
+			name, _, _ := strings.Cut(line, ":")
+			skipping = fields[strings.ToLower(strings.TrimSpace(name))]
+			if skipping {
+				fmt.Fprintf(buf, "%v: %v\r\n", strings.TrimSpace(name), redacted)
+			}
+		}
+		if skipping {
+			continue
+		}
+		if recipientPattern != nil {
+			line = recipientPattern.ReplaceAllString(line, "${1}"+redacted+"@")
+		}
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
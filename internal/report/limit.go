@@ -0,0 +1,52 @@
+package report
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows limit events per key in every interval, a limit of zero allows any number.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	limit    int
+	interval time.Duration
+	windows  map[string]*window
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// rateLimiterPrune is the number of keys at which expired windows are forgotten.
+const rateLimiterPrune = 10000
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, interval: interval, windows: make(map[string]*window)}
+}
+
+// allow counts an event for key at now and reports whether it is within the limit.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.interval {
+		if len(l.windows) >= rateLimiterPrune {
+			for k, v := range l.windows {
+				if now.Sub(v.start) >= l.interval {
+					delete(l.windows, k)
+				}
+			}
+		}
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	if w.count >= l.limit {
+		return false
+	}
+	w.count++
+	return true
+}
@@ -0,0 +1,183 @@
+package report_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/report"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingForwarder struct {
+	mutex    sync.Mutex
+	messages []*mailer.Message
+	// refuse is an address mail to which fails.
+	refuse string
+}
+
+func (f *recordingForwarder) ForwardMail(ctx context.Context, msg *mailer.Message) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if msg.To == f.refuse {
+		return errors.New("550 5.1.1 no such user")
+	}
+	f.messages = append(f.messages, msg)
+	return nil
+}
+
+func (f *recordingForwarder) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.messages)
+}
+
+func evaluation(ip string, rua ...string) report.Evaluation {
+	record, _ := dmarc.Parse("v=DMARC1; p=reject")
+	record.ReportURIAggregate = rua
+	return report.Evaluation{
+		SourceIP:     net.ParseIP(ip),
+		HeaderFrom:   "user@example.com",
+		EnvelopeFrom: "bounce@example.com",
+		Disposition:  dmarc.PolicyNone,
+		Auth: check.AuthResults{
+			SPF:   &check.SPFResult{Value: authres.ResultPass, MailFrom: "bounce@example.com"},
+			DKIM:  &check.DKIMResult{Signatures: []check.DKIMSignature{{Value: authres.ResultPass, Domain: "example.com", Selector: "s1"}}},
+			DMARC: &check.DMARCResult{Value: authres.ResultPass, From: "example.com", PolicyDomain: "example.com", Record: record, Policy: dmarc.PolicyReject, SPFAligned: true, DKIMAligned: true},
+		},
+	}
+}
+
+func TestAggregateReport(t *testing.T) {
+	aggregator := report.NewAggregator(store.NewMemoryStore(), 24*time.Hour)
+	now := time.Date(2023, 1, 2, 15, 0, 0, 0, time.UTC)
+	rua := []string{"mailto:dmarc@example.com", "mailto:reports@vendor.example.net", "mailto:small@example.com!1"}
+	assert.NoError(t, aggregator.Record(evaluation("192.0.2.1", rua...), now))
+	assert.NoError(t, aggregator.Record(evaluation("192.0.2.1", rua...), now))
+	assert.NoError(t, aggregator.Record(evaluation("192.0.2.2", rua...), now))
+	// Domains that do not ask for reports are not recorded.
+	assert.NoError(t, aggregator.Record(evaluation("192.0.2.3"), now))
+
+	forwarder := &recordingForwarder{}
+	reporter := report.NewReporter(aggregator, forwarder, "dmarc-reports@maskr.app", "maskr.app")
+	reporter.Resolver = &resolver.Zone{}
+
+	assert.NoError(t, reporter.Send(context.Background(), now))
+	assert.Empty(t, forwarder.messages, "the period did not end yet")
+
+	assert.NoError(t, reporter.Send(context.Background(), now.Add(24*time.Hour)))
+	// The vendor did not publish example.com._report._dmarc.vendor.example.net, the last address is too small.
+	assert.Len(t, forwarder.messages, 1)
+	msg := forwarder.messages[0]
+	assert.Equal(t, "dmarc@example.com", msg.To)
+	assert.True(t, msg.System)
+	assert.Equal(t, "maskr.app!example.com!1672617600!1672703999.xml.gz", msg.Attachments[0].Filename)
+
+	reader, err := gzip.NewReader(bytes.NewReader(msg.Attachments[0].Data))
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	feedback := &report.Feedback{}
+	assert.NoError(t, xml.Unmarshal(data, feedback))
+	assert.Equal(t, "example.com", feedback.Published.Domain)
+	assert.Len(t, feedback.Records, 2)
+	assert.Equal(t, 2, feedback.Records[0].Row.Count)
+	assert.Equal(t, "s1", feedback.Records[0].AuthResults.DKIM[0].Selector)
+
+	forwarder.messages = nil
+	assert.NoError(t, reporter.Send(context.Background(), now.Add(48*time.Hour)))
+	assert.Empty(t, forwarder.messages, "reported aggregates are removed")
+}
+
+func failure(fo string) report.Failure {
+	ev := evaluation("192.0.2.1")
+	record, _ := dmarc.Parse("v=DMARC1; p=reject; ruf=mailto:forensic@example.com; " + fo)
+	ev.Auth.DMARC = &check.DMARCResult{Value: authres.ResultFail, From: "example.com", PolicyDomain: "example.com", Record: record, Policy: dmarc.PolicyReject}
+	ev.Disposition = dmarc.PolicyReject
+	return report.Failure{
+		Evaluation: ev,
+		Recipient:  "alice@maskr.app",
+		Arrival:    time.Now(),
+		Message: []byte("Received: from mail.example.com by mx.maskr.app\r\n\tfor <alice@maskr.app>; Mon, 02 Jan 2023 15:04:05 +0000\r\n" +
+			"From: ceo@example.com\r\nTo: Alice <alice@maskr.app>,\r\n\tbob@maskr.app\r\nSubject: Invoice\r\n\r\nPay now\r\n"),
+	}
+}
+
+func TestWantsReport(t *testing.T) {
+	assert.True(t, report.WantsReport(failure("").Auth))
+	// Both SPF and the DKIM signature passed, just not aligned.
+	assert.False(t, report.WantsReport(failure("fo=s:d").Auth))
+
+	none := failure("")
+	none.Auth.DMARC.Policy = dmarc.PolicyNone
+	assert.False(t, report.WantsReport(none.Auth))
+}
+
+func TestFailureReport(t *testing.T) {
+	forwarder := &recordingForwarder{}
+	reporter := report.NewFailureReporter(forwarder, "dmarc-reports@maskr.app", "maskr.app", "mx.maskr.app", report.Redaction{Fields: []string{"To"}, Recipients: true}, report.FailureLimits{})
+	reporter.Resolver = &resolver.Zone{}
+	assert.NoError(t, reporter.Report(context.Background(), failure("")))
+
+	assert.Len(t, forwarder.messages, 1)
+	msg := forwarder.messages[0]
+	assert.Equal(t, "forensic@example.com", msg.To)
+	assert.True(t, msg.System)
+	assert.Equal(t, "feedback-report", msg.Report.Type)
+	assert.Contains(t, string(msg.Report.Parts[0].Data), "Feedback-Type: auth-failure\r\n")
+	assert.Contains(t, string(msg.Report.Parts[0].Data), "Delivery-Result: reject\r\n")
+
+	header := string(msg.Report.Parts[1].Data)
+	assert.Contains(t, header, "To: redacted\r\nSubject: Invoice\r\n")
+	assert.Contains(t, header, "for <redacted@maskr.app>")
+	assert.NotContains(t, header, "alice")
+	assert.NotContains(t, header, "Pay now")
+}
+
+func TestFailureReportLimits(t *testing.T) {
+	forwarder := &recordingForwarder{}
+	limits := report.FailureLimits{PerDomain: 3, PerAddress: 2, Interval: time.Hour, Queue: 2}
+	reporter := report.NewFailureReporter(forwarder, "dmarc-reports@maskr.app", "maskr.app", "mx.maskr.app", report.Redaction{}, limits)
+	reporter.Resolver = &resolver.Zone{}
+
+	assert.True(t, reporter.Enqueue(failure("")))
+	assert.True(t, reporter.Enqueue(failure("")))
+	assert.False(t, reporter.Enqueue(failure("")), "the queue is full")
+	assert.False(t, reporter.Enqueue(failure("")), "example.com had its share of reports")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reporter.Run(ctx)
+	assert.Eventually(t, func() bool { return forwarder.count() == 2 }, time.Second, 10*time.Millisecond)
+
+	// The ruf= address had its share too.
+	assert.NoError(t, reporter.Report(context.Background(), failure("")))
+	assert.Len(t, forwarder.messages, 2)
+}
+
+func TestFailureReportSkipsUnreachableAddresses(t *testing.T) {
+	forwarder := &recordingForwarder{refuse: "broken@example.com"}
+	reporter := report.NewFailureReporter(forwarder, "dmarc-reports@maskr.app", "maskr.app", "mx.maskr.app", report.Redaction{}, report.FailureLimits{})
+	reporter.Resolver = &resolver.Zone{}
+
+	f := failure("")
+	f.Auth.DMARC.Record.ReportURIFailure = []string{"mailto:broken@example.com", "mailto:forensic@example.com"}
+	err := reporter.Report(context.Background(), f)
+	assert.ErrorContains(t, err, "broken@example.com")
+	if assert.Len(t, forwarder.messages, 1) {
+		assert.Equal(t, "forensic@example.com", forwarder.messages[0].To)
+	}
+}
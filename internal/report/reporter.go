@@ -0,0 +1,206 @@
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Reporter sends the aggregate reports (RFC 7489 section 7.2) of every finished period.
+type Reporter struct {
+	aggregator *Aggregator
+	forwarder  mailer.Forwarder
+	// Resolver verifies report addresses outside the policy domain, resolver.Default when nil.
+	Resolver resolver.Resolver
+	from     string
+	orgName  string
+}
+
+// NewReporter creates a reporter that sends the reports from the address from, on behalf of orgName.
+func NewReporter(aggregator *Aggregator, forwarder mailer.Forwarder, from, orgName string) *Reporter {
+	return &Reporter{aggregator: aggregator, forwarder: forwarder, from: from, orgName: orgName}
+}
+
+// Run sends the due reports until ctx is cancelled.
+func (r *Reporter) Run(ctx context.Context) {
+	interval := time.Hour
+	if r.aggregator.period < interval {
+		interval = r.aggregator.period
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Send(ctx, time.Now()); err != nil {
+			logrus.Errorf("error sending DMARC aggregate reports: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send queues the reports of the periods that ended before now and forgets their aggregates.
+func (r *Reporter) Send(ctx context.Context, now time.Time) error {
+	keys, err := r.aggregator.Due(now)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		aggregate, err := r.aggregator.Load(key)
+		if err != nil {
+			return err
+		}
+		if err := r.send(ctx, aggregate); err != nil {
+			// Kept for the next run, the queue was not able to take it.
+			logrus.Errorf("error sending DMARC aggregate report for %v: %v", aggregate.Domain, err)
+			continue
+		}
+		if err := r.aggregator.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reporter) send(ctx context.Context, aggregate *Aggregate) error {
+	feedback, err := aggregate.Feedback(r.orgName, r.from)
+	if err != nil {
+		return err
+	}
+	data, err := xml.MarshalIndent(feedback, "", "  ")
+	if err != nil {
+		return err
+	}
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte(xml.Header))
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	// The file name is specified in RFC 7489 section 7.2.1.1.
+	filename := fmt.Sprintf("%v!%v!%v!%v.xml.gz", r.orgName, aggregate.Domain, feedback.Metadata.DateRange.Begin, feedback.Metadata.DateRange.End)
+
+	for _, uri := range aggregate.RUA {
+		to, limit, err := parseReportURI(uri)
+		if err != nil {
+			logrus.Debugf("skipping DMARC report URI %v of %v: %v", uri, aggregate.Domain, err)
+			continue
+		}
+		if limit > 0 && int64(compressed.Len()) > limit {
+			logrus.Debugf("DMARC report for %v exceeds the limit of %v", aggregate.Domain, uri)
+			continue
+		}
+		if !verifyDestination(ctx, r.Resolver, aggregate.Domain, to) {
+			logrus.Debugf("%v did not agree to receive DMARC reports for %v", to, aggregate.Domain)
+			continue
+		}
+		err = r.forwarder.ForwardMail(ctx, &mailer.Message{
+			FromName: r.orgName,
+			From:     r.from,
+			To:       to,
+			Subject:  fmt.Sprintf("Report Domain: %v Submitter: %v Report-ID: %v", aggregate.Domain, r.orgName, feedback.Metadata.ReportID),
+			System:   true,
+			Headers: []mailer.Header{
+				{Key: "Auto-Submitted", Value: "auto-generated"},
+			},
+			Content: mailer.Content{
+				TextBody: fmt.Sprintf("This is a DMARC aggregate report for %v from %v.\r\n", aggregate.Domain, r.orgName),
+				Attachments: []mailer.Attachment{
+					{Filename: filename, ContentType: "application/gzip", Data: compressed.Bytes()},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDestination checks that a report address outside the organizational domain of domain agreed to receive
+// its reports (RFC 7489 section 7.1).
+func verifyDestination(ctx context.Context, r resolver.Resolver, domain, to string) bool {
+	destination := domainOf(to)
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return false
+	}
+	orgDestination, err := publicsuffix.EffectiveTLDPlusOne(destination)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(orgDomain, orgDestination) {
+		return true
+	}
+	txts, err := resolver.OrDefault(r).LookupTXT(ctx, domain+"._report._dmarc."+destination)
+	if err != nil {
+		return false
+	}
+	for _, v := range txts {
+		if strings.HasPrefix(v, "v=DMARC1") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReportURI returns the address of a mailto: report URI and its size limit in bytes, zero for none.
+func parseReportURI(uri string) (string, int64, error) {
+	uri = strings.TrimSpace(uri)
+	var limit int64
+	if i := strings.LastIndex(uri, "!"); i != -1 {
+		size := uri[i+1:]
+		uri = uri[:i]
+		multiplier := int64(1)
+		if size != "" {
+			switch strings.ToLower(size[len(size)-1:]) {
+			case "k":
+				multiplier = 1 << 10
+			case "m":
+				multiplier = 1 << 20
+			case "g":
+				multiplier = 1 << 30
+			case "t":
+				multiplier = 1 << 40
+			}
+			if multiplier > 1 {
+				size = size[:len(size)-1]
+			}
+		}
+		parsed, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid size limit: %v", err)
+		}
+		limit = parsed * multiplier
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", 0, err
+	}
+	if !strings.EqualFold(parsed.Scheme, "mailto") {
+		return "", 0, errors.New("only mailto: report URIs are supported")
+	}
+	address, err := url.PathUnescape(parsed.Opaque)
+	if err != nil {
+		return "", 0, err
+	}
+	if !strings.Contains(address, "@") {
+		return "", 0, errors.New("invalid address")
+	}
+	return address, limit, nil
+}
@@ -0,0 +1,259 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Type is the kind of records a lookup asks for.
+type Type string
+
+const (
+	TypeTXT Type = "TXT"
+	TypeMX  Type = "MX"
+	// TypeIP asks for both A and AAAA records.
+	TypeIP  Type = "IP"
+	TypePTR Type = "PTR"
+)
+
+// Answer is the outcome of one lookup, only the field of its type is set.
+type Answer struct {
+	TXT   []string
+	MX    []*net.MX
+	IP    []net.IPAddr
+	Names []string
+	// TTL is how long the answer may be cached. For a name that does not exist it is the negative TTL of the zone
+	// (RFC 2308 section 5).
+	TTL time.Duration
+}
+
+// Exchanger is implemented by resolvers that know the TTLs of their answers. When a lookup finds nothing it returns
+// the answer along with the error, so the negative TTL is known too.
+type Exchanger interface {
+	Exchange(ctx context.Context, t Type, name string) (*Answer, error)
+}
+
+// CacheStats counts what happened to the lookups of a Cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Shared lookups waited for an identical lookup that was already running.
+	Shared    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// Cache is a Resolver that remembers the answers of its upstream, including names that do not exist. Temporary
+// failures are not cached. Concurrent identical lookups are sent upstream once.
+type Cache struct {
+	upstream Resolver
+	// TTL and NegativeTTL apply when the upstream is not an Exchanger, like the system resolver, which does not tell
+	// the TTLs of its answers. MaxTTL caps every TTL.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MaxTTL      time.Duration
+	// Timeout bounds a lookup sent upstream. It is not cancelled with the lookup that started it, since other
+	// lookups may be waiting for its answer.
+	Timeout time.Duration
+
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	// recent orders the entries from most to least recently used.
+	recent *list.List
+	group  singleflight.Group
+
+	hits, misses, shared, evictions uint64
+}
+
+type cacheEntry struct {
+	key     string
+	answer  *Answer
+	err     error
+	expires time.Time
+}
+
+// NewCache creates a cache in front of upstream that holds at most maxEntries answers.
+func NewCache(upstream Resolver, maxEntries int) *Cache {
+	return &Cache{
+		upstream:    upstream,
+		TTL:         5 * time.Minute,
+		NegativeTTL: time.Minute,
+		MaxTTL:      time.Hour,
+		Timeout:     30 * time.Second,
+		maxEntries:  maxEntries,
+		entries:     make(map[string]*list.Element),
+		recent:      list.New(),
+	}
+}
+
+func (c *Cache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := c.lookup(ctx, TypeTXT, normalize(name))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), answer.TXT...), nil
+}
+
+func (c *Cache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := c.lookup(ctx, TypeMX, normalize(name))
+	if err != nil {
+		return nil, err
+	}
+	return append([]*net.MX(nil), answer.MX...), nil
+}
+
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	answer, err := c.lookup(ctx, TypeIP, normalize(host))
+	if err != nil {
+		return nil, err
+	}
+	return append([]net.IPAddr(nil), answer.IP...), nil
+}
+
+func (c *Cache) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	answer, err := c.lookup(ctx, TypePTR, addr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), answer.Names...), nil
+}
+
+// Stats returns the counters of the cache since it was created.
+func (c *Cache) Stats() CacheStats {
+	c.mutex.Lock()
+	entries := len(c.entries)
+	c.mutex.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Shared:    atomic.LoadUint64(&c.shared),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Entries:   entries,
+	}
+}
+
+// LogStats logs the statistics every interval until ctx is cancelled, as those of the cache called name.
+func (c *Cache) LogStats(ctx context.Context, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := c.Stats()
+		logrus.Infof("dns cache %v: %v hits, %v misses, %v shared, %v evictions, %v entries", name, stats.Hits, stats.Misses, stats.Shared, stats.Evictions, stats.Entries)
+	}
+}
+
+func (c *Cache) lookup(ctx context.Context, t Type, name string) (*Answer, error) {
+	key := string(t) + " " + name
+	if entry, ok := c.get(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return entry.answer, entry.err
+	}
+	leader := false
+	results := c.group.DoChan(key, func() (interface{}, error) {
+		leader = true
+		atomic.AddUint64(&c.misses, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		answer, err := c.exchange(ctx, t, name)
+		if err == nil || IsNotFound(err) {
+			c.put(key, answer, err)
+		}
+		return answer, err
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		if !leader {
+			atomic.AddUint64(&c.shared, 1)
+		}
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*Answer), nil
+	}
+}
+
+// exchange asks the upstream, with the default TTLs when it does not report them.
+func (c *Cache) exchange(ctx context.Context, t Type, name string) (*Answer, error) {
+	if exchanger, ok := c.upstream.(Exchanger); ok {
+		return exchanger.Exchange(ctx, t, name)
+	}
+	answer := &Answer{TTL: c.TTL}
+	var err error
+	switch t {
+	case TypeTXT:
+		answer.TXT, err = c.upstream.LookupTXT(ctx, name)
+	case TypeMX:
+		answer.MX, err = c.upstream.LookupMX(ctx, name)
+	case TypeIP:
+		answer.IP, err = c.upstream.LookupIPAddr(ctx, name)
+	case TypePTR:
+		answer.Names, err = c.upstream.LookupAddr(ctx, name)
+	}
+	if err != nil {
+		answer.TTL = c.NegativeTTL
+	}
+	return answer, err
+}
+
+func (c *Cache) get(key string) (*cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.recent.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.recent.MoveToFront(element)
+	return entry, true
+}
+
+func (c *Cache) put(key string, answer *Answer, err error) {
+	if answer == nil || c.maxEntries <= 0 {
+		return
+	}
+	ttl := answer.TTL
+	if ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry := &cacheEntry{key: key, answer: answer, err: err, expires: time.Now().Add(ttl)}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(entry)
+	for len(c.entries) > c.maxEntries {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
@@ -0,0 +1,133 @@
+package resolver_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingZone counts the lookups that reach it, and holds them until release is closed.
+type countingZone struct {
+	*resolver.Zone
+	lookups int64
+	release chan struct{}
+}
+
+func (z *countingZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	atomic.AddInt64(&z.lookups, 1)
+	if z.release != nil {
+		<-z.release
+	}
+	return z.Zone.LookupTXT(ctx, name)
+}
+
+// ttlZone reports a TTL of one millisecond for every answer.
+type ttlZone struct {
+	*countingZone
+}
+
+func (z ttlZone) Exchange(ctx context.Context, t resolver.Type, name string) (*resolver.Answer, error) {
+	txts, err := z.LookupTXT(ctx, name)
+	return &resolver.Answer{TXT: txts, TTL: time.Millisecond}, err
+}
+
+func newZone() *countingZone {
+	return &countingZone{Zone: &resolver.Zone{
+		TXT:      map[string][]string{"a.example": {"a"}, "b.example": {"b"}, "c.example": {"c"}},
+		ServFail: map[string]bool{"flaky.example": true},
+	}}
+}
+
+func TestCache(t *testing.T) {
+	zone := newZone()
+	cache := resolver.NewCache(zone, 2)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		txts, err := cache.LookupTXT(ctx, "A.example.")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, txts)
+	}
+	assert.EqualValues(t, 1, zone.lookups)
+
+	// Names that do not exist are cached, failures are not.
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupTXT(ctx, "missing.example")
+		assert.True(t, resolver.IsNotFound(err))
+		_, err = cache.LookupTXT(ctx, "flaky.example")
+		assert.Error(t, err)
+		assert.False(t, resolver.IsNotFound(err))
+	}
+	assert.EqualValues(t, 4, zone.lookups)
+
+	// a.example was used least recently, so it makes room for c.example.
+	cache.LookupTXT(ctx, "c.example")
+	cache.LookupTXT(ctx, "a.example")
+	assert.EqualValues(t, 6, zone.lookups)
+
+	stats := cache.Stats()
+	assert.Equal(t, resolver.CacheStats{Hits: 3, Misses: 6, Evictions: 2, Entries: 2}, stats)
+}
+
+func TestCacheTTL(t *testing.T) {
+	zone := newZone()
+	cache := resolver.NewCache(ttlZone{zone}, 10)
+	cache.LookupTXT(context.Background(), "a.example")
+	time.Sleep(5 * time.Millisecond)
+	cache.LookupTXT(context.Background(), "a.example")
+	assert.EqualValues(t, 2, zone.lookups)
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	zone := newZone()
+	zone.release = make(chan struct{})
+	cache := resolver.NewCache(zone, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txts, err := cache.LookupTXT(context.Background(), "b.example")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b"}, txts)
+		}()
+	}
+	// Give the lookups time to line up behind the first one.
+	time.Sleep(20 * time.Millisecond)
+	close(zone.release)
+	wg.Wait()
+	assert.EqualValues(t, 1, zone.lookups)
+	assert.EqualValues(t, 1, cache.Stats().Misses)
+	assert.EqualValues(t, 9, cache.Stats().Shared)
+}
+
+func TestCacheLeaderCancelled(t *testing.T) {
+	zone := newZone()
+	zone.release = make(chan struct{})
+	cache := resolver.NewCache(zone, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := cache.LookupTXT(ctx, "b.example")
+		leader <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	follower := make(chan []string, 1)
+	go func() {
+		txts, _ := cache.LookupTXT(context.Background(), "b.example")
+		follower <- txts
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The leader gives up, the lookup it started goes on for the follower.
+	cancel()
+	assert.ErrorIs(t, <-leader, context.Canceled)
+	close(zone.release)
+	assert.Equal(t, []string{"b"}, <-follower)
+	assert.EqualValues(t, 1, zone.lookups)
+}
@@ -0,0 +1,470 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Transports of the upstream name servers.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	// TransportTLS is DNS over TLS (RFC 7858).
+	TransportTLS = "tls"
+	// TransportHTTPS is DNS over HTTPS (RFC 8484).
+	TransportHTTPS = "https"
+)
+
+// ednsSize is the UDP payload size advertised to the servers, as recommended by DNS flag day 2020.
+const ednsSize = 1232
+
+// Server is an upstream name server.
+type Server struct {
+	Transport string
+	// Address is host:port, or the URL for https.
+	Address string
+	// ServerName is what the certificate of a tls server must be valid for, https uses the host of the URL.
+	ServerName string
+}
+
+func (s Server) String() string {
+	return s.Transport + "://" + s.Address
+}
+
+// ParseServer parses a server like "1.1.1.1", "tcp://1.1.1.1:53", "tls://dns.quad9.net",
+// "tls://9.9.9.9:853#dns.quad9.net" or "https://cloudflare-dns.com/dns-query". Without a scheme it is udp.
+func ParseServer(s string) (Server, error) {
+	if !strings.Contains(s, "://") {
+		s = TransportUDP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Server{}, err
+	}
+	server := Server{Transport: u.Scheme, Address: u.Host, ServerName: u.Fragment}
+	var port string
+	switch u.Scheme {
+	case TransportUDP, TransportTCP:
+		port = "53"
+	case TransportTLS:
+		port = "853"
+	case TransportHTTPS:
+		u.Fragment = ""
+		return Server{Transport: u.Scheme, Address: u.String()}, nil
+	default:
+		return Server{}, fmt.Errorf("unsupported DNS transport %v", u.Scheme)
+	}
+	if u.Host == "" {
+		return Server{}, fmt.Errorf("missing host in DNS server %v", s)
+	}
+	if u.Port() == "" {
+		server.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if server.ServerName == "" {
+		server.ServerName = u.Hostname()
+	}
+	return server, nil
+}
+
+// ParseServers parses a list of servers with ParseServer.
+func ParseServers(list []string) ([]Server, error) {
+	servers := make([]Server, 0, len(list))
+	for _, v := range list {
+		server, err := ParseServer(v)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// SystemServers returns the name servers of a resolv.conf file, like /etc/resolv.conf, as plain DNS servers. Servers
+// that cannot be written as a URL, like link-local addresses with a zone, are left out.
+func SystemServers(path string) ([]Server, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []Server
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		server, err := ParseServer(TransportUDP + "://" + net.JoinHostPort(fields[1], "53"))
+		if err != nil {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// Client is a Resolver that asks its servers directly instead of going through the system resolver. The servers
+// are tried in order until one answers. It reports the TTLs of the answers, so a Cache can honour them.
+type Client struct {
+	Servers []Server
+	// Timeout limits every attempt at one server.
+	Timeout time.Duration
+	// TLSConfig is the base for tls and https servers, with the roots of the system when nil.
+	TLSConfig *tls.Config
+
+	httpOnce   sync.Once
+	httpClient *http.Client
+}
+
+func NewClient(servers []Server, timeout time.Duration) *Client {
+	return &Client{Servers: servers, Timeout: timeout}
+}
+
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := c.Exchange(ctx, TypeTXT, name)
+	if err != nil {
+		return nil, err
+	}
+	return answer.TXT, nil
+}
+
+func (c *Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := c.Exchange(ctx, TypeMX, name)
+	if err != nil {
+		return nil, err
+	}
+	return answer.MX, nil
+}
+
+func (c *Client) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	answer, err := c.Exchange(ctx, TypeIP, host)
+	if err != nil {
+		return nil, err
+	}
+	return answer.IP, nil
+}
+
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	answer, err := c.Exchange(ctx, TypePTR, addr)
+	if err != nil {
+		return nil, err
+	}
+	return answer.Names, nil
+}
+
+// Exchange looks up name. Like the net package, it fails with a not found error when the name exists without
+// records of the type.
+func (c *Client) Exchange(ctx context.Context, t Type, name string) (*Answer, error) {
+	switch t {
+	case TypeIP:
+		return c.exchangeIP(ctx, name)
+	case TypePTR:
+		ip := net.ParseIP(name)
+		if ip == nil {
+			return nil, &net.DNSError{Err: "unrecognized address", Name: name}
+		}
+		return c.exchange(ctx, ReverseName(ip), dnsmessage.TypePTR)
+	case TypeTXT:
+		return c.exchange(ctx, name, dnsmessage.TypeTXT)
+	case TypeMX:
+		return c.exchange(ctx, name, dnsmessage.TypeMX)
+	default:
+		return nil, fmt.Errorf("unsupported lookup type %v", t)
+	}
+}
+
+// exchangeIP asks for the A and the AAAA records of host. It succeeds when either has addresses.
+func (c *Client) exchangeIP(ctx context.Context, host string) (*Answer, error) {
+	v4, err4 := c.exchange(ctx, host, dnsmessage.TypeA)
+	v6, err6 := c.exchange(ctx, host, dnsmessage.TypeAAAA)
+	answer := &Answer{}
+	for _, v := range []*Answer{v4, v6} {
+		if v == nil {
+			continue
+		}
+		answer.IP = append(answer.IP, v.IP...)
+		if answer.TTL == 0 || v.TTL < answer.TTL {
+			answer.TTL = v.TTL
+		}
+	}
+	if len(answer.IP) > 0 {
+		return answer, nil
+	}
+	if err4 != nil && !IsNotFound(err4) {
+		return nil, err4
+	}
+	if err6 != nil && !IsNotFound(err6) {
+		return nil, err6
+	}
+	return answer, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (c *Client) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*Answer, error) {
+	response, err := c.query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	answer := &Answer{}
+	// The answer lives as long as the shortest lived record of it, including the CNAMEs leading to it.
+	ttl := ^uint32(0)
+	found := false
+	for _, v := range response.Answers {
+		if v.Header.Type != qtype && v.Header.Type != dnsmessage.TypeCNAME {
+			continue
+		}
+		if v.Header.TTL < ttl {
+			ttl = v.Header.TTL
+		}
+		switch body := v.Body.(type) {
+		case *dnsmessage.TXTResource:
+			answer.TXT = append(answer.TXT, strings.Join(body.TXT, ""))
+		case *dnsmessage.MXResource:
+			answer.MX = append(answer.MX, &net.MX{Host: body.MX.String(), Pref: body.Pref})
+		case *dnsmessage.AResource:
+			answer.IP = append(answer.IP, net.IPAddr{IP: net.IP(body.A[:])})
+		case *dnsmessage.AAAAResource:
+			answer.IP = append(answer.IP, net.IPAddr{IP: net.IP(body.AAAA[:])})
+		case *dnsmessage.PTRResource:
+			answer.Names = append(answer.Names, body.PTR.String())
+		default:
+			continue
+		}
+		found = true
+	}
+	if found {
+		sort.SliceStable(answer.MX, func(i, j int) bool {
+			return answer.MX[i].Pref < answer.MX[j].Pref
+		})
+		answer.TTL = time.Duration(ttl) * time.Second
+		return answer, nil
+	}
+	// The negative TTL is the smaller of the TTL and the minimum field of the SOA record (RFC 2308 section 5).
+	for _, v := range response.Authorities {
+		if soa, ok := v.Body.(*dnsmessage.SOAResource); ok {
+			ttl = v.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			answer.TTL = time.Duration(ttl) * time.Second
+		}
+	}
+	return answer, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// query asks the servers in turn, until one gives an answer that is not a server failure.
+func (c *Client) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: "invalid name", Name: name}
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	lastErr := errors.New("no DNS servers")
+	for _, server := range c.Servers {
+		response, err := c.ask(ctx, server, question)
+		if err != nil {
+			logrus.Debugf("dns query for %v %v at %v failed: %v", name, qtype, server, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return response, nil
+	}
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true, IsTimeout: errors.Is(lastErr, context.DeadlineExceeded)}
+}
+
+func (c *Client) ask(ctx context.Context, server Server, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var id uint16
+	// DNS over HTTPS uses ID 0, so the answers can be cached by HTTP caches (RFC 8484 section 4.1).
+	if server.Transport != TransportHTTPS {
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		id = binary.BigEndian.Uint16(b[:])
+	}
+	request, err := newRequest(id, question)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch server.Transport {
+	case TransportUDP:
+		raw, err = c.exchangeUDP(ctx, server, request)
+	case TransportTCP, TransportTLS:
+		raw, err = c.exchangeStream(ctx, server, request)
+	case TransportHTTPS:
+		raw, err = c.exchangeHTTPS(ctx, server, request)
+	default:
+		err = fmt.Errorf("unsupported DNS transport %v", server.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	response := &dnsmessage.Message{}
+	if err := response.Unpack(raw); err != nil {
+		return nil, err
+	}
+	// An answer over UDP that does not fit is retried over TCP (RFC 7766 section 5).
+	if response.Truncated && server.Transport == TransportUDP {
+		return c.ask(ctx, Server{Transport: TransportTCP, Address: server.Address}, question)
+	}
+	if response.ID != id || len(response.Questions) != 1 || !strings.EqualFold(response.Questions[0].Name.String(), question.Name.String()) {
+		return nil, errors.New("answer does not match the question")
+	}
+	if response.RCode != dnsmessage.RCodeSuccess && response.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("server answered %v", response.RCode)
+	}
+	return response, nil
+}
+
+func newRequest(id uint16, question dnsmessage.Question) ([]byte, error) {
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	if err := opt.Header.SetEDNS0(ednsSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	message := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{opt},
+	}
+	return message.Pack()
+}
+
+func (c *Client) exchangeUDP(ctx context.Context, server Server, request []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", server.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// exchangeStream sends request over TCP or TLS, where messages are prefixed with their length.
+func (c *Client) exchangeStream(ctx context.Context, server Server, request []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if server.Transport == TransportTLS {
+		dialer := &tls.Dialer{Config: c.tlsConfig(server)}
+		conn, err = dialer.DialContext(ctx, "tcp", server.Address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", server.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2, 2+len(request))
+	binary.BigEndian.PutUint16(framed, uint16(len(request)))
+	if _, err := conn.Write(append(framed, request...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *Client) exchangeHTTPS(ctx context.Context, server Server, request []byte) ([]byte, error) {
+	c.httpOnce.Do(func() {
+		c.httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   c.tlsConfig(Server{}),
+			ForceAttemptHTTP2: true,
+		}}
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.Address, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered with HTTP status %v", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// tlsConfig returns the TLS configuration for server.
+func (c *Client) tlsConfig(server Server) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if server.ServerName != "" {
+		config.ServerName = server.ServerName
+	}
+	return config
+}
+
+// ReverseName returns the name of the PTR records of ip, in in-addr.arpa or ip6.arpa.
+func ReverseName(ip net.IP) string {
+	if ip.To4() != nil {
+		return ReverseIP(ip) + ".in-addr.arpa"
+	}
+	return ReverseIP(ip) + ".ip6.arpa"
+}
+
+// ReverseIP returns the labels of ip in reverse order, the octets of an IPv4 address or the nibbles of an IPv6
+// address (RFC 3596 section 2.5), as used for reverse lookups and DNSBL queries.
+func ReverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	labels := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[v6[i]&0xf]), string(hex[v6[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
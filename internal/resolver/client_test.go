@@ -0,0 +1,186 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answer is a name server for example.com. Over UDP, big.example.com does not fit and is truncated.
+func answer(request []byte, udp bool) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(request); err != nil {
+		return nil
+	}
+	question := query.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 300}
+	switch question.Name.String() {
+	case "example.com.":
+		response.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}}}}
+	case "big.example.com.":
+		if udp {
+			response.Truncated = true
+			break
+		}
+		response.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{"big"}}}}
+	case "1.2.0.192.in-addr.arpa.":
+		response.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("mail.example.com.")}}}
+	case "broken.example.com.":
+		response.RCode = dnsmessage.RCodeServerFailure
+	default:
+		response.RCode = dnsmessage.RCodeNameError
+		response.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example.com."),
+				MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+				MinTTL: 60,
+			},
+		}}
+	}
+	raw, _ := response.Pack()
+	return raw
+}
+
+// serve answers over UDP and TCP on the same port, and returns its address.
+func serve(t *testing.T) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { packetConn.Close() })
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(answer(buffer[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			io.ReadFull(conn, length[:])
+			request := make([]byte, binary.BigEndian.Uint16(length[:]))
+			io.ReadFull(conn, request)
+			response := answer(request, false)
+			binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+			conn.Write(append(length[:], response...))
+			conn.Close()
+		}
+	}()
+	return packetConn.LocalAddr().String()
+}
+
+func TestClient(t *testing.T) {
+	address := serve(t)
+	client := resolver.NewClient([]resolver.Server{{Transport: resolver.TransportUDP, Address: address}}, time.Second)
+	ctx := context.Background()
+
+	answer, err := client.Exchange(ctx, resolver.TypeTXT, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all"}, answer.TXT)
+	assert.Equal(t, 300*time.Second, answer.TTL)
+
+	txts, err := client.LookupTXT(ctx, "big.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"big"}, txts)
+
+	names, err := client.LookupAddr(ctx, "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mail.example.com."}, names)
+
+	answer, err = client.Exchange(ctx, resolver.TypeTXT, "missing.example.com")
+	assert.True(t, resolver.IsNotFound(err))
+	assert.Equal(t, 60*time.Second, answer.TTL)
+
+	_, err = client.LookupTXT(ctx, "broken.example.com")
+	assert.Error(t, err)
+	assert.False(t, resolver.IsNotFound(err))
+}
+
+func TestClientFailover(t *testing.T) {
+	// Nothing listens on the first server.
+	unused, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dead := unused.LocalAddr().String()
+	unused.Close()
+
+	client := resolver.NewClient([]resolver.Server{
+		{Transport: resolver.TransportUDP, Address: dead},
+		{Transport: resolver.TransportTCP, Address: serve(t)},
+	}, 200*time.Millisecond)
+	txts, err := client.LookupTXT(context.Background(), "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all"}, txts)
+}
+
+func TestClientHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answer(request, false))
+	}))
+	defer server.Close()
+
+	client := resolver.NewClient([]resolver.Server{{Transport: resolver.TransportHTTPS, Address: server.URL + "/dns-query"}}, time.Second)
+	client.TLSConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	txts, err := client.LookupTXT(context.Background(), "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all"}, txts)
+}
+
+func TestParseServer(t *testing.T) {
+	tests := map[string]resolver.Server{
+		"1.1.1.1":                          {Transport: "udp", Address: "1.1.1.1:53", ServerName: "1.1.1.1"},
+		"tcp://[2606:4700::1111]":          {Transport: "tcp", Address: "[2606:4700::1111]:53", ServerName: "2606:4700::1111"},
+		"tls://9.9.9.9:853#dns.quad9.net":  {Transport: "tls", Address: "9.9.9.9:853", ServerName: "dns.quad9.net"},
+		"https://dns.google/dns-query#foo": {Transport: "https", Address: "https://dns.google/dns-query"},
+	}
+	for input, expected := range tests {
+		server, err := resolver.ParseServer(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, server, input)
+	}
+	_, err := resolver.ParseServer("quic://dns.adguard.com")
+	assert.Error(t, err)
+}
+
+func TestReverseName(t *testing.T) {
+	assert.Equal(t, "1.2.0.192.in-addr.arpa", resolver.ReverseName(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", resolver.ReverseName(net.ParseIP("2001:db8::1")))
+}
+
+func TestSystemServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "# generated\nsearch example.com\nnameserver 192.0.2.53\nnameserver 2001:db8::53\nnameserver fe80::1%eth0\noptions edns0\n"
+	assert.NoError(t, os.WriteFile(path, []byte(conf), 0o600))
+	servers, err := resolver.SystemServers(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []resolver.Server{
+		{Transport: "udp", Address: "192.0.2.53:53", ServerName: "192.0.2.53"},
+		{Transport: "udp", Address: "[2001:db8::53]:53", ServerName: "2001:db8::53"},
+	}, servers)
+}
@@ -0,0 +1,32 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Resolver answers the DNS lookups of the checks. *net.Resolver satisfies it, and so does Zone.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Default is the resolver of the system.
+var Default Resolver = net.DefaultResolver
+
+// OrDefault returns r, or Default when r is nil.
+func OrDefault(r Resolver) Resolver {
+	if r == nil {
+		return Default
+	}
+	return r
+}
+
+// IsNotFound reports whether err says that the name or record does not exist, as opposed to a failed lookup.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
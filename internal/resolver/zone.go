@@ -0,0 +1,74 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Zone is an in-memory Resolver, so checks can run without a network. Its maps are keyed by lower case names
+// without the trailing dot, lookups match them with or without it. A name missing from a map does not exist.
+type Zone struct {
+	TXT map[string][]string
+	MX  map[string][]*net.MX
+	// IP holds the A and AAAA records.
+	IP map[string][]net.IP
+	// PTR holds the reverse records, by address.
+	PTR map[string][]string
+	// ServFail names fail temporarily, like behind an unreachable name server.
+	ServFail map[string]bool
+}
+
+func (z *Zone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name, err := z.find(name, len(z.TXT[normalize(name)]) > 0)
+	if err != nil {
+		return nil, err
+	}
+	return z.TXT[name], nil
+}
+
+func (z *Zone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name, err := z.find(name, len(z.MX[normalize(name)]) > 0)
+	if err != nil {
+		return nil, err
+	}
+	return z.MX[name], nil
+}
+
+func (z *Zone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host, err := z.find(host, len(z.IP[normalize(host)]) > 0)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(z.IP[host]))
+	for _, v := range z.IP[host] {
+		addrs = append(addrs, net.IPAddr{IP: v})
+	}
+	return addrs, nil
+}
+
+func (z *Zone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	addr, err := z.find(addr, len(z.PTR[addr]) > 0)
+	if err != nil {
+		return nil, err
+	}
+	return z.PTR[addr], nil
+}
+
+func (z *Zone) find(name string, exists bool) (string, error) {
+	normalized := normalize(name)
+	if z.ServFail[normalized] {
+		return "", &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if !exists {
+		return "", &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return normalized, nil
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
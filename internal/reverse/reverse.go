@@ -0,0 +1,105 @@
+package reverse
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/maskrapp/relay/internal/store"
+)
+
+// Reverse aliases let mask owners reply to forwarded mail without exposing their real address.
+// Every external contact of a mask gets its own address on the reply domain; mail the owner sends to it
+// is delivered to the contact with the mask as sender.
+
+var ErrNotFound = errors.New("reverse alias not found")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Alias struct {
+	// Address is the reply address on our domain.
+	Address string
+	// Mask is the mask the contact originally wrote to.
+	Mask string
+	// Contact is the external address replies are delivered to.
+	Contact string
+}
+
+type Aliases struct {
+	store  store.Store
+	domain string
+	mutex  sync.Mutex
+}
+
+func New(s store.Store, domain string) *Aliases {
+	return &Aliases{
+		store:  s,
+		domain: strings.ToLower(domain),
+	}
+}
+
+// IsReverseAlias reports whether address belongs to the reply domain.
+func (a *Aliases) IsReverseAlias(address string) bool {
+	i := strings.LastIndex(address, "@")
+	return i != -1 && strings.EqualFold(address[i+1:], a.domain)
+}
+
+// Lookup returns the alias for a reply address.
+func (a *Aliases) Lookup(address string) (*Alias, error) {
+	data, err := a.store.Get(aliasKey(address))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	alias := &Alias{}
+	if err := json.Unmarshal(data, alias); err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+// Get returns the alias of contact for mask, creating it the first time the contact writes to the mask.
+func (a *Aliases) Get(mask, contact string) (*Alias, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	address, err := a.store.Get(contactKey(mask, contact))
+	if err == nil {
+		return a.Lookup(string(address))
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	alias := &Alias{
+		Address: "r." + strings.ToLower(encoding.EncodeToString(b)) + "@" + a.domain,
+		Mask:    strings.ToLower(mask),
+		Contact: contact,
+	}
+	data, err := json.Marshal(alias)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.Put(aliasKey(alias.Address), data); err != nil {
+		return nil, err
+	}
+	if err := a.store.Put(contactKey(mask, contact), []byte(alias.Address)); err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+func aliasKey(address string) string {
+	return "reverse/alias/" + strings.ToLower(address)
+}
+
+func contactKey(mask, contact string) string {
+	return "reverse/contact/" + strings.ToLower(mask) + "/" + strings.ToLower(contact)
+}
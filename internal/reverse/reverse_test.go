@@ -0,0 +1,36 @@
+package reverse_test
+
+import (
+	"testing"
+
+	"github.com/maskrapp/relay/internal/reverse"
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAliases(t *testing.T) {
+	fileStore, err := store.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	aliases := reverse.New(fileStore, "reply.maskr.app")
+
+	alias, err := aliases.Get("mask@maskr.app", "alice@example.com")
+	assert.NoError(t, err)
+	assert.True(t, aliases.IsReverseAlias(alias.Address))
+	assert.False(t, aliases.IsReverseAlias("alice@example.com"))
+
+	again, err := aliases.Get("MASK@maskr.app", "Alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, alias.Address, again.Address)
+
+	other, err := aliases.Get("mask@maskr.app", "bob@example.com")
+	assert.NoError(t, err)
+	assert.NotEqual(t, alias.Address, other.Address)
+
+	found, err := aliases.Lookup(alias.Address)
+	assert.NoError(t, err)
+	assert.Equal(t, "mask@maskr.app", found.Mask)
+	assert.Equal(t, "alice@example.com", found.Contact)
+
+	_, err = aliases.Lookup("r.unknown@reply.maskr.app")
+	assert.ErrorIs(t, err, reverse.ErrNotFound)
+}
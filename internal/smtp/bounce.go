@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/maskrapp/relay/internal/bounce"
+	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// bounceReporter tells the backend about a bounce of a message forwarded from mask.
+type bounceReporter func(mask, messageId string, report *bounce.Report)
+
+func createBounceReporter(apiClient main_api.MainAPIServiceClient, tracker *bounce.Tracker, threshold int) bounceReporter {
+	return func(mask, messageId string, report *bounce.Report) {
+		req := &main_api.ReportBounceRequest{
+			MaskAddress:  mask,
+			Recipient:    report.Recipient,
+			Status:       report.Status,
+			Diagnostic:   report.Diagnostic,
+			FeedbackType: report.FeedbackType,
+			Hard:         report.Hard(),
+		}
+		if report.Hard() {
+			count, err := tracker.RecordHard(mask, messageId)
+			if err != nil {
+				logrus.Errorf("error recording bounce: %v", err)
+			}
+			req.HardBounceCount = int32(count)
+			req.Disable = threshold > 0 && count >= threshold
+		}
+		logrus.Infof("bounce for mask %v: action=%v status=%v feedback=%v disable=%v", mask, report.Action, report.Status, report.FeedbackType, req.Disable)
+		if _, err := apiClient.ReportBounce(context.TODO(), req); err != nil {
+			logrus.Errorf("grpc error(ReportBounce): %v", err)
+		}
+	}
+}
+
+// acceptBounce accepts mail to the bounce domain from any sender, including the null sender, as long as the VERP address is genuine.
+func acceptBounce(verp *bounce.Verp, to string) bool {
+	_, _, err := verp.Decode(to)
+	if err != nil {
+		logrus.Debugf("rejecting mail to bounce address %v: %v", to, err)
+		return false
+	}
+	return true
+}
+
+// handleBounce reports a bounce or feedback report for a forwarded message. Anything else sent to a VERP address is dropped.
+func handleBounce(verp *bounce.Verp, report bounceReporter, parsedMail *mail.Message, to string) error {
+	mask, messageId, err := verp.Decode(to)
+	if err != nil {
+		return err
+	}
+	parsed, err := bounce.Parse(textproto.MIMEHeader(parsedMail.Header), parsedMail.Body)
+	if err != nil {
+		if errors.Is(err, bounce.ErrNotBounce) {
+			logrus.Debugf("discarding mail to bounce address of mask %v: %v", mask, err)
+			return nil
+		}
+		return err
+	}
+	report(mask, messageId, parsed)
+	return nil
+}
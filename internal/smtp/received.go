@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maskrapp/smtpd"
+)
+
+// tlsSessions remembers the TLS state of connections by remote address, smtpd does not hand it to the handler.
+// A state is forgotten when its connection closes, which needs the connections to come from listen.
+type tlsSessions struct {
+	mutex  sync.Mutex
+	states map[string]tls.ConnectionState
+}
+
+func newTLSSessions() *tlsSessions {
+	return &tlsSessions{states: make(map[string]tls.ConnectionState)}
+}
+
+// wrap returns a copy of config that records the state of every completed handshake.
+func (s *tlsSessions) wrap(config *tls.Config) *tls.Config {
+	wrapped := config.Clone()
+	wrapped.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		addr := hello.Conn.RemoteAddr().String()
+		perConn := config.Clone()
+		perConn.VerifyConnection = func(state tls.ConnectionState) error {
+			s.put(addr, state)
+			return nil
+		}
+		return perConn, nil
+	}
+	return wrapped
+}
+
+// listen returns ln with connections that forget their TLS state when they are closed.
+func (s *tlsSessions) listen(ln net.Listener) net.Listener {
+	return &sessionListener{Listener: ln, sessions: s}
+}
+
+func (s *tlsSessions) put(addr string, state tls.ConnectionState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.states[addr] = state
+}
+
+func (s *tlsSessions) get(addr net.Addr) *tls.ConnectionState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[addr.String()]
+	if !ok {
+		return nil
+	}
+	return &state
+}
+
+func (s *tlsSessions) remove(addr net.Addr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.states, addr.String())
+}
+
+type sessionListener struct {
+	net.Listener
+	sessions *tlsSessions
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionConn{Conn: conn, sessions: l.sessions}, nil
+}
+
+// sessionConn is keyed by the address of its peer, so behind a proxy that sends a PROXY protocol header the state
+// recorded under the client address is not the one removed.
+type sessionConn struct {
+	net.Conn
+	sessions *tlsSessions
+}
+
+func (c *sessionConn) Close() error {
+	c.sessions.remove(c.RemoteAddr())
+	return c.Conn.Close()
+}
+
+// receivedStamper records the relay in the trace of every accepted message (RFC 5321 section 4.4).
+type receivedStamper struct {
+	hostname string
+	sessions *tlsSessions
+}
+
+// stamp returns the unfolded value of the Received header for a message accepted with the session ID id,
+// and the message data with that header in place of the minimal one smtpd adds.
+func (r *receivedStamper) stamp(data smtpd.HandlerData, id string) (string, []byte) {
+	ip, _, err := net.SplitHostPort(data.RemoteAddr.String())
+	if err != nil {
+		ip = data.RemoteAddr.String()
+	}
+	ptr := strings.TrimSuffix(data.RemoteHost, ".")
+	if ptr == "" {
+		ptr = "unknown"
+	}
+	helo := data.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	protocol := "ESMTP"
+	lines := []string{fmt.Sprintf("from %v (%v [%v])", helo, ptr, ip)}
+	if state := r.sessions.get(data.RemoteAddr); state != nil {
+		protocol = "ESMTPS"
+		lines = append(lines, fmt.Sprintf("(using %v with cipher %v)", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	}
+	lines = append(lines, fmt.Sprintf("by %v (maskr relay) with %v id %v", r.hostname, protocol, id))
+	lines = append(lines, fmt.Sprintf("for <%v>; %v", data.To[0], time.Now().Format(time.RFC1123Z)))
+	stamped := bytes.NewBufferString("Received: " + strings.Join(lines, "\r\n\t") + "\r\n")
+	stamped.Write(stripReceived(data.Data))
+	return strings.Join(lines, " "), stamped.Bytes()
+}
+
+// stripReceived removes the first header field of data if it is a Received field.
+func stripReceived(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte("Received:")) {
+		return data
+	}
+	rest := data
+	for {
+		i := bytes.Index(rest, []byte("\r\n"))
+		if i == -1 {
+			return data
+		}
+		rest = rest[i+2:]
+		if len(rest) == 0 || (rest[0] != ' ' && rest[0] != '\t') {
+			return rest
+		}
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
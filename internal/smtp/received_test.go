@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+const smtpdReceived = "Received: from mail.example.com (mail.example.com. [192.0.2.1])\r\n" +
+	"        by mx.maskr.app (smtpd) with SMTP\r\n" +
+	"        for <mask@maskr.app>; Mon,  2 Jan 2023 15:04:05 +0000 (UTC)\r\n"
+
+func TestStripReceived(t *testing.T) {
+	tests := map[string]struct {
+		data     string
+		expected string
+	}{
+		"added by smtpd":      {smtpdReceived + "Subject: Hello\r\n\r\nHello\r\n", "Subject: Hello\r\n\r\nHello\r\n"},
+		"tab folded":          {"Received: from a\r\n\tby b\r\nSubject: Hello\r\n\r\n", "Subject: Hello\r\n\r\n"},
+		"only the first":      {"Received: from a\r\nReceived: from b\r\n\r\n", "Received: from b\r\n\r\n"},
+		"no header":           {"Subject: Hello\r\n\r\nHello\r\n", "Subject: Hello\r\n\r\nHello\r\n"},
+		"other field":         {"Received-SPF: pass\r\nSubject: Hello\r\n\r\n", "Received-SPF: pass\r\nSubject: Hello\r\n\r\n"},
+		"nothing else":        {"Received: from a\r\n\tby b\r\n", ""},
+		"unterminated":        {"Received: from a", "Received: from a"},
+		"unterminated folded": {"Received: from a\r\n\tby b", "Received: from a\r\n\tby b"},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.expected, string(stripReceived([]byte(test.data))), name)
+	}
+}
+
+func TestStamp(t *testing.T) {
+	sessions := newTLSSessions()
+	secure := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2525}
+	sessions.put(secure.String(), tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256})
+	stamper := &receivedStamper{hostname: "mx.maskr.app", sessions: sessions}
+
+	tests := map[string]struct {
+		data     smtpd.HandlerData
+		expected []string
+	}{
+		"plain": {
+			smtpd.HandlerData{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2525}, RemoteHost: "mail.example.com.", Helo: "mail.example.com"},
+			[]string{"from mail.example.com (mail.example.com [192.0.2.1])", "by mx.maskr.app (maskr relay) with ESMTP id 1234"},
+		},
+		"tls": {
+			smtpd.HandlerData{RemoteAddr: secure, RemoteHost: "mail.example.com.", Helo: "mail.example.com"},
+			[]string{"from mail.example.com (mail.example.com [192.0.2.2])", "(using TLS1.3 with cipher TLS_AES_128_GCM_SHA256)", "by mx.maskr.app (maskr relay) with ESMTPS id 1234"},
+		},
+		"unknown client": {
+			smtpd.HandlerData{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2525}},
+			[]string{"from unknown (unknown [2001:db8::1])", "by mx.maskr.app (maskr relay) with ESMTP id 1234"},
+		},
+	}
+	for name, test := range tests {
+		test.data.To = []string{"mask@maskr.app", "other@maskr.app"}
+		test.data.Data = []byte(smtpdReceived + "Subject: Hello\r\n\r\nHello\r\n")
+		received, stamped := stamper.stamp(test.data, "1234")
+
+		// The date is the time of stamping.
+		assert.True(t, strings.HasPrefix(received, strings.Join(test.expected, " ")+" for <mask@maskr.app>; "), name)
+		header, body, found := strings.Cut(string(stamped), "\r\nSubject: Hello\r\n")
+		assert.True(t, found, name)
+		assert.Equal(t, "\r\nHello\r\n", body, name)
+		assert.Equal(t, "Received: "+strings.Join(append(test.expected, ""), "\r\n\t"), header[:strings.LastIndex(header, "for <")], name)
+		assert.Equal(t, 1, strings.Count(string(stamped), "Received:"), name)
+	}
+}
+
+func TestTLSSessionsForgetClosedConnections(t *testing.T) {
+	sessions := newTLSSessions()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ln = sessions.listen(ln)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+
+	sessions.put(conn.RemoteAddr().String(), tls.ConnectionState{Version: tls.VersionTLS13})
+	assert.NotNil(t, sessions.get(client.LocalAddr()))
+	assert.NoError(t, conn.Close())
+	assert.Nil(t, sessions.get(client.LocalAddr()))
+}
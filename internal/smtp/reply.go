@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/mailer"
+	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/maskrapp/relay/internal/reverse"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+// acceptReply only accepts mail to a reverse alias from the real address of the mask owner.
+func acceptReply(backendClient main_api.MainAPIServiceClient, aliases *reverse.Aliases, from, to string) bool {
+	alias, err := aliases.Lookup(to)
+	if err != nil {
+		if !errors.Is(err, reverse.ErrNotFound) {
+			logrus.Errorf("reverse alias error: %v", err)
+		}
+		return false
+	}
+	resp, err := backendClient.GetMask(context.TODO(), &main_api.GetMaskRequest{MaskAddress: alias.Mask})
+	if err != nil {
+		logrus.Errorf("grpc error(GetMask): %v", err)
+		return false
+	}
+	return resp.Enabled && strings.EqualFold(resp.Email, from)
+}
+
+// handleReply delivers a reply from the mask owner to the contact behind a reverse alias, with the mask as sender.
+func handleReply(apiClient main_api.MainAPIServiceClient, forwarder mailer.Forwarder, limits mailer.Limits, aliases *reverse.Aliases, parsedMail *mail.Message, to string, auth check.AuthResults) error {
+	alias, err := aliases.Lookup(to)
+	if err != nil {
+		return err
+	}
+	resp, err := apiClient.GetMask(context.TODO(), &main_api.GetMaskRequest{MaskAddress: alias.Mask})
+	if err != nil {
+		logrus.Errorf("grpc error(GetMask): %v", err)
+		return err
+	}
+	// The envelope sender was checked in acceptReply, the header sender must be the owner too and authenticated.
+	addresses, err := parsedMail.Header.AddressList("From")
+	if err != nil || len(addresses) == 0 || !strings.EqualFold(addresses[0].Address, resp.Email) {
+		return fmt.Errorf("reply to %v was not sent by the owner of the mask", to)
+	}
+	if !authenticatedReply(auth, resp.Email) {
+		logrus.Infof("refusing reply to %v: the domain of %v did not authenticate it", to, resp.Email)
+		return fmt.Errorf("reply to %v is not authenticated", to)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsedMail.Header.Get("Subject"))
+	if err != nil {
+		subject = parsedMail.Header.Get("Subject")
+	}
+	content, err := mailer.ParseContent(textproto.MIMEHeader(parsedMail.Header), parsedMail.Body, limits)
+	if err != nil {
+		logrus.Errorf("error parsing content of reply: %v", err)
+		return err
+	}
+	// Quoted text and signatures often repeat the owner's address, and the reverse alias the owner replied to.
+	replacer := strings.NewReplacer(resp.Email, alias.Mask, alias.Address, alias.Contact)
+	content.TextBody = replacer.Replace(content.TextBody)
+	content.HTMLBody = replacer.Replace(content.HTMLBody)
+
+	err = forwarder.ForwardMail(context.TODO(), &mailer.Message{
+		From:         alias.Mask,
+		To:           alias.Contact,
+		EnvelopeFrom: alias.Mask,
+		Subject:      subject,
+		Reply:        true,
+		Headers:      mailer.ReplyHeaders(parsedMail.Header),
+		Content:      *content,
+	})
+	if err != nil {
+		logrus.Errorf("queue err: %v", err)
+		return err
+	}
+	logrus.Debugf("Queued reply from mask %v to: %v", alias.Mask, alias.Contact)
+	return nil
+}
+
+// authenticatedReply reports whether the domain of from vouches for a reply: DMARC passed, or when the domain has no
+// DMARC record, SPF or a DKIM signature passed for it with relaxed alignment.
+func authenticatedReply(auth check.AuthResults, from string) bool {
+	if auth.DMARC != nil && auth.DMARC.Record != nil {
+		return auth.DMARC.Value == authres.ResultPass
+	}
+	_, domain, _ := strings.Cut(from, "@")
+	if auth.DKIM != nil {
+		for _, v := range auth.DKIM.Passing() {
+			if !v.ThirdParty {
+				return true
+			}
+		}
+	}
+	return auth.SPF != nil && auth.SPF.Value == authres.ResultPass && sameOrganization(auth.SPF.Domain(), domain)
+}
+
+func sameOrganization(a, b string) bool {
+	orgA, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(a))
+	if err != nil {
+		return false
+	}
+	orgB, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(b))
+	return err == nil && orgA == orgB
+}
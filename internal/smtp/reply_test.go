@@ -0,0 +1,33 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatedReply(t *testing.T) {
+	record := &dmarc.Record{Policy: dmarc.PolicyReject}
+	aligned := &check.DKIMResult{Signatures: []check.DKIMSignature{{Value: authres.ResultPass, Domain: "example.com"}}}
+	thirdParty := &check.DKIMResult{Signatures: []check.DKIMSignature{{Value: authres.ResultPass, Domain: "esp.example", ThirdParty: true}}}
+	spfPass := &check.SPFResult{Value: authres.ResultPass, MailFrom: "bounces@mail.example.com"}
+	spfForeign := &check.SPFResult{Value: authres.ResultPass, MailFrom: "bounces@esp.example"}
+	tests := map[string]struct {
+		auth     check.AuthResults
+		expected bool
+	}{
+		"dmarc pass":                  {check.AuthResults{DMARC: &check.DMARCResult{Value: authres.ResultPass, Record: record}}, true},
+		"dmarc fail despite dkim":     {check.AuthResults{DKIM: aligned, DMARC: &check.DMARCResult{Value: authres.ResultFail, Record: record}}, false},
+		"no record, aligned dkim":     {check.AuthResults{DKIM: aligned, DMARC: &check.DMARCResult{Value: authres.ResultNone}}, true},
+		"no record, aligned spf":      {check.AuthResults{SPF: spfPass, DMARC: &check.DMARCResult{Value: authres.ResultNone}}, true},
+		"no record, third-party dkim": {check.AuthResults{DKIM: thirdParty, DMARC: &check.DMARCResult{Value: authres.ResultNone}}, false},
+		"no record, foreign spf":      {check.AuthResults{SPF: spfForeign, DMARC: &check.DMARCResult{Value: authres.ResultNone}}, false},
+		"nothing":                     {check.AuthResults{}, false},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.expected, authenticatedReply(test.auth, "owner@example.com"), name)
+	}
+}
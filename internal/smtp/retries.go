@@ -0,0 +1,71 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/maskrapp/smtpd"
+)
+
+// smtpd answers every handler error with a temporary failure, so a refused message comes back until its sender gives
+// up. retries remembers the refused messages for as long as senders usually retry (RFC 5321 section 4.5.4.1), so
+// what is reported about a message is reported once.
+type retries struct {
+	mutex  sync.Mutex
+	seen   map[string]time.Time
+	window time.Duration
+	max    int
+}
+
+func newRetries(window time.Duration, max int) *retries {
+	return &retries{seen: make(map[string]time.Time), window: window, max: max}
+}
+
+// first reports whether the message with key was not refused within the window, and remembers it.
+func (r *retries) first(key string) bool {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if seen, ok := r.seen[key]; ok && now.Sub(seen) < r.window {
+		return false
+	}
+	if len(r.seen) >= r.max {
+		r.prune(now)
+	}
+	r.seen[key] = now
+	return true
+}
+
+// prune forgets the expired messages, or the oldest one when none expired.
+func (r *retries) prune(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, seen := range r.seen {
+		if now.Sub(seen) >= r.window {
+			delete(r.seen, key)
+			continue
+		}
+		if oldestKey == "" || seen.Before(oldest) {
+			oldestKey, oldest = key, seen
+		}
+	}
+	if len(r.seen) >= r.max {
+		delete(r.seen, oldestKey)
+	}
+}
+
+// retryKey identifies a message across delivery attempts by its envelope and content, without the Received header smtpd
+// adds, which is dated at every attempt.
+func retryKey(data smtpd.HandlerData) string {
+	hash := sha256.New()
+	hash.Write([]byte(data.From))
+	for _, to := range data.To {
+		hash.Write([]byte{0})
+		hash.Write([]byte(to))
+	}
+	hash.Write([]byte{0})
+	hash.Write(stripReceived(data.Data))
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maskrapp/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+// attempt returns the data smtpd hands to the handler for a message sent at at.
+func attempt(to string, body string, at time.Time) smtpd.HandlerData {
+	received := "Received: from mail.example.com (mail.example.com. [192.0.2.1])\r\n" +
+		"        by mx.maskr.app (smtpd) with SMTP\r\n" +
+		"        for <" + to + ">; " + at.Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)") + "\r\n"
+	return smtpd.HandlerData{From: "alice@example.com", To: []string{to}, Data: []byte(received + "Subject: Hello\r\n\r\n" + body + "\r\n")}
+}
+
+func TestRetries(t *testing.T) {
+	sent := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	data := attempt("mask@maskr.app", "Hello", sent)
+	retry := attempt("mask@maskr.app", "Hello", sent.Add(30*time.Minute))
+	other := attempt("mask@maskr.app", "Hello again", sent)
+
+	refused := newRetries(time.Hour, 2)
+	assert.True(t, refused.first(retryKey(data)))
+	assert.False(t, refused.first(retryKey(retry)), "a retry of the same message")
+	assert.True(t, refused.first(retryKey(other)))
+
+	// The oldest message is forgotten to make room.
+	third := attempt("other@maskr.app", "Hello", sent)
+	assert.True(t, refused.first(retryKey(third)))
+	assert.True(t, refused.first(retryKey(retry)))
+
+	expired := newRetries(0, 10)
+	assert.True(t, expired.first(retryKey(data)))
+	assert.True(t, expired.first(retryKey(retry)), "the sender gave up long ago")
+}
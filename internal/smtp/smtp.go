@@ -5,16 +5,29 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
+	"mime"
 	"net"
 	"net/mail"
+	"net/textproto"
 	"strings"
 	"time"
 
-	"github.com/DusanKasan/parsemail"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/arc"
+	"github.com/maskrapp/relay/internal/bounce"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/config"
+	"github.com/maskrapp/relay/internal/dsn"
 	"github.com/maskrapp/relay/internal/global"
+	"github.com/maskrapp/relay/internal/loop"
 	"github.com/maskrapp/relay/internal/mailer"
 	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/maskrapp/relay/internal/policy"
+	"github.com/maskrapp/relay/internal/queue"
+	"github.com/maskrapp/relay/internal/report"
+	"github.com/maskrapp/relay/internal/reverse"
+	"github.com/maskrapp/relay/internal/srs"
 	"github.com/maskrapp/relay/internal/validation"
 	"github.com/maskrapp/smtpd"
 	"github.com/sirupsen/logrus"
@@ -22,13 +35,115 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func New(ctx global.Context) *smtpd.Server {
+// Server is the smtpd server of the relay, listening with connections that clean up after themselves.
+type Server struct {
+	*smtpd.Server
+	sessions *tlsSessions
+	// backend is closed on shutdown, if it holds resources like the file of the file backend.
+	backend io.Closer
+}
+
+// ListenAndServe listens on the TCP address s.Addr and serves the connections.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(s.sessions.listen(ln))
+}
+
+// Shutdown stops the server gracefully and then closes the delivery backend.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if s.backend != nil {
+		if closeErr := s.backend.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func New(ctx global.Context) *Server {
 	validator := validation.NewValidator(ctx)
-	mailer := mailer.New(ctx.Config().ZeptoMail.EmailToken)
+	aliases := reverse.New(ctx.Instances().Store, ctx.Config().ReverseAliasDomain)
+	verp, err := bounce.NewVerp(ctx.Config().Bounce.Secret, ctx.Config().Mailer.BounceAddress)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	// Only the mx backend rewrites envelope senders, the others deliver with their own bounce address.
+	var rewriter *srs.Rewriter
+	if ctx.Config().Mailer.Backend == "mx" {
+		rewriter, err = srs.New(ctx.Config().SRS.Secret, ctx.Config().SRS.Domain)
+		if err != nil {
+			logrus.Panic(err)
+		}
+	}
+	tracker := bounce.NewTracker(ctx.Instances().Store)
+	reportBounce := createBounceReporter(ctx.Instances().GrpcClient, tracker, ctx.Config().Bounce.DisableThreshold)
+	backend, err := mailer.New(ctx.Config())
+	if err != nil {
+		logrus.Panic(err)
+	}
+	closer, _ := backend.(io.Closer)
+	if ctx.Config().ARC.PrivateKey != "" {
+		sealer, err := arc.NewSealer(ctx.Config().ARC.Domain, ctx.Config().ARC.Selector, []byte(ctx.Config().ARC.PrivateKey))
+		if err != nil {
+			logrus.Panic(err)
+		}
+		// ZeptoMail builds the message itself from the JSON fields, a seal would not survive it.
+		if ctx.Config().Mailer.Backend == "zeptomail" {
+			logrus.Warn("ARC sealing is not supported by the zeptomail backend")
+		} else {
+			backend = arc.NewForwarder(backend, sealer)
+			logrus.Info("Enabled ARC sealing")
+		}
+	}
+	forwarder := queue.New(ctx.Instances().Store, backend, queue.Options{
+		Workers:    ctx.Config().Queue.Workers,
+		Lifetime:   ctx.Config().Queue.Lifetime,
+		MinBackoff: ctx.Config().Queue.MinBackoff,
+		MaxBackoff: ctx.Config().Queue.MaxBackoff,
+	})
+	forwarder.OnDelivered = createDeliveredHandler(ctx.Instances().GrpcClient, tracker)
+	forwarder.OnFailed = createFailedHandler(ctx.Instances().GrpcClient, forwarder, reportBounce, ctx.Config())
+	go forwarder.Run(ctx)
+
+	var reports *report.Aggregator
+	var failures *report.FailureReporter
+	if cfg := ctx.Config().DMARCReports; cfg.Address != "" {
+		reports = report.NewAggregator(ctx.Instances().Store, cfg.Interval)
+		reporter := report.NewReporter(reports, forwarder, cfg.Address, cfg.OrgName)
+		reporter.Resolver = ctx.Instances().Resolver
+		go reporter.Run(ctx)
+		if cfg.Failures {
+			redaction := report.Redaction{Fields: cfg.RedactFields, Recipients: cfg.RedactRecipients}
+			failureLimits := report.FailureLimits{
+				PerDomain:  cfg.FailureDomainLimit,
+				PerAddress: cfg.FailureAddressLimit,
+				Interval:   cfg.FailureLimitInterval,
+				Queue:      cfg.FailureQueue,
+			}
+			failures = report.NewFailureReporter(forwarder, cfg.Address, cfg.OrgName, ctx.Config().Hostname, redaction, failureLimits)
+			failures.Resolver = ctx.Instances().Resolver
+			go failures.Run(ctx)
+		}
+	}
+
+	loops := loop.New(ctx.Config().Hostname, ctx.Config().Loop.MaxReceived, ctx.Config().Loop.MaxPasses)
+	stamper := &receivedStamper{hostname: ctx.Config().Hostname, sessions: newTLSSessions()}
+	// Senders give up after four or five days.
+	refused := newRetries(5*24*time.Hour, 100000)
+
+	limits := mailer.Limits{
+		MaxAttachmentSize: ctx.Config().Mailer.MaxAttachmentSize,
+		MaxTotalSize:      ctx.Config().Mailer.MaxMessageSize,
+	}
 
 	smtpdServer := &smtpd.Server{
 		Addr:     "0.0.0.0:25",
+		Appname:  "smtpd",
 		Timeout:  time.Minute,
+		MaxSize:  ctx.Config().Mailer.MaxMessageSize,
 		Hostname: ctx.Config().Hostname,
 		Debug:    ctx.Config().Logger.LogLevel == "debug",
 		LogWrite: func(remoteIP, verb, line string) {
@@ -39,8 +154,8 @@ func New(ctx global.Context) *smtpd.Server {
 		LogRead: func(remoteIP, verb, line string) {
 			logrus.Infof("[READ] %v %v %v", remoteIP, verb, line)
 		},
-		HandlerRcpt: createHanderRcpt(ctx.Instances().GrpcClient),
-		Handler:     createHandler(ctx.Instances().GrpcClient, validator, mailer),
+		HandlerRcpt: createHanderRcpt(ctx.Instances().GrpcClient, aliases, verp, rewriter),
+		Handler:     createHandler(ctx.Instances().GrpcClient, validator, forwarder, limits, aliases, verp, rewriter, reportBounce, stamper, loops, refused, reports, failures),
 	}
 
 	if ctx.Config().Production {
@@ -48,20 +163,30 @@ func New(ctx global.Context) *smtpd.Server {
 		if err != nil {
 			logrus.Panic(err)
 		}
-		smtpdServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		smtpdServer.TLSConfig = stamper.sessions.wrap(&tls.Config{Certificates: []tls.Certificate{cert}})
 		smtpdServer.TLSRequired = true
 		logrus.Info("Enabled TLS")
 	}
 
-	return smtpdServer
+	return &Server{Server: smtpdServer, sessions: stamper.sessions, backend: closer}
 }
 
-func createHanderRcpt(backendClient main_api.MainAPIServiceClient) smtpd.HandlerRcpt {
+func createHanderRcpt(backendClient main_api.MainAPIServiceClient, aliases *reverse.Aliases, verp *bounce.Verp, rewriter *srs.Rewriter) smtpd.HandlerRcpt {
 	return func(remoteAddr net.Addr, from, to string) bool {
+		// Bounces come from the null sender.
+		if rewriter != nil && rewriter.IsSRSAddress(to) {
+			return acceptSRSBounce(rewriter, to)
+		}
+		if verp.IsBounceAddress(to) {
+			return acceptBounce(verp, to)
+		}
 		_, err := mail.ParseAddress(from)
 		if err != nil {
 			return false
 		}
+		if aliases.IsReverseAlias(to) {
+			return acceptReply(backendClient, aliases, from, to)
+		}
 		_, err = backendClient.CheckMask(context.TODO(), &main_api.CheckMaskRequest{MaskAddress: to})
 		if err != nil {
 			status := status.Convert(err)
@@ -74,9 +199,18 @@ func createHanderRcpt(backendClient main_api.MainAPIServiceClient) smtpd.Handler
 	}
 }
 
-func createHandler(apiClient main_api.MainAPIServiceClient, validator *validation.MailValidator, mailer *mailer.Mailer) smtpd.Handler {
+func createHandler(apiClient main_api.MainAPIServiceClient, validator *validation.MailValidator, forwarder mailer.Forwarder, limits mailer.Limits, aliases *reverse.Aliases, verp *bounce.Verp, rewriter *srs.Rewriter, reportBounce bounceReporter, stamper *receivedStamper, loops *loop.Detector, refused *retries, reports *report.Aggregator, failures *report.FailureReporter) smtpd.Handler {
 	return func(data smtpd.HandlerData) error {
-		parsedMail, err := parsemail.Parse(bytes.NewReader(data.Data))
+		// The session ID ends up in our Received header and in the bounce address of the forwarded message.
+		messageId, err := bounce.NewMessageId()
+		if err != nil {
+			return err
+		}
+		attempt := retryKey(data)
+		received, stamped := stamper.stamp(data, messageId)
+		data.Data = stamped
+
+		parsedMail, err := mail.ReadMessage(bytes.NewReader(data.Data))
 		if err != nil {
 			logrus.Error("error parsing incoming email:", err)
 			return err
@@ -85,11 +219,40 @@ func createHandler(apiClient main_api.MainAPIServiceClient, validator *validatio
 		if !ok {
 			return errors.New("error casting origin to net.TCPAddr")
 		}
-		logrus.Debug("Incoming mail from:", parsedMail.From, data.From)
+		logrus.Debug("Incoming mail from:", parsedMail.Header.Get("From"), data.From)
+
+		// data.To will always have 1 element.
+		to := data.To[0]
+
+		// Bounces are authenticated by their VERP or SRS address, most of them come from the null sender and would not pass the checks.
+		if rewriter != nil && rewriter.IsSRSAddress(to) {
+			return handleSRSBounce(apiClient, forwarder, limits, rewriter, parsedMail, to)
+		}
+		if verp.IsBounceAddress(to) {
+			return handleBounce(verp, reportBounce, parsedMail, to)
+		}
+
+		if err := loops.Check(parsedMail.Header); err != nil {
+			logrus.Infof("rejecting mail to %v: %v", to, err)
+			var loopErr *loop.Error
+			if !errors.As(err, &loopErr) {
+				return err
+			}
+			// Some senders retry even a permanent failure, the backend hears about the loop once.
+			if !aliases.IsReverseAlias(to) && refused.first(attempt) {
+				_, innerErr := apiClient.ReportLoop(context.TODO(), &main_api.ReportLoopRequest{MaskAddress: to, Reason: loopErr.Reason, Hops: int32(loopErr.Hops)})
+				if innerErr != nil {
+					logrus.Errorf("grpc error(ReportLoop): %v", innerErr)
+				}
+			}
+			// Retrying does not break a loop, the sender has to bounce the message (RFC 5321 section 6.3).
+			return &smtpd.Error{Code: 554, EnhancedCode: "5.4.6", Message: "Mail loop detected: " + loopErr.Reason}
+		}
 
-		var from string
-		if len(parsedMail.From) > 0 && parsedMail.From[0] != nil {
-			from = parsedMail.From[0].Address
+		var from, fromName string
+		if addresses, err := parsedMail.Header.AddressList("From"); err == nil && len(addresses) > 0 {
+			from = addresses[0].Address
+			fromName = addresses[0].Name
 		}
 
 		ctx := context.TODO() //TODO: change the context once this is implemented in the smtpd package.
@@ -101,17 +264,44 @@ func createHandler(apiClient main_api.MainAPIServiceClient, validator *validatio
 			Ip:           ip.IP,
 		}
 		result := validator.RunChecks(ctx, values)
-		if result.Reject {
-			logrus.Infof("rejecting incoming mail for reason: %v", result.Reason)
-			return errors.New(result.Reason)
+		evaluation := report.Evaluation{
+			SourceIP:     ip.IP,
+			HeaderFrom:   from,
+			EnvelopeFrom: data.From,
+			Disposition:  disposition(result.Verdict.Action),
+			Auth:         result.Auth,
+		}
+		// A temporary failure is not an outcome yet, and a rejected message is only recorded and reported the first time
+		// it is sent.
+		final := result.Verdict.Action != policy.Tempfail && (result.Verdict.Action != policy.Reject || refused.first(attempt))
+		if reports != nil && final {
+			if err := reports.Record(evaluation, time.Now()); err != nil {
+				logrus.Errorf("error recording DMARC evaluation: %v", err)
+			}
+		}
+		if failures != nil && final && report.WantsReport(result.Auth) {
+			// Verifying the report addresses takes DNS lookups, the sender should not wait for them.
+			failures.Enqueue(report.Failure{Evaluation: evaluation, Recipient: to, Arrival: time.Now(), Message: data.Data})
+		}
+		switch result.Verdict.Action {
+		case policy.Reject, policy.Tempfail:
+			// smtpd answers every handler error with a temporary failure, so both actions look alike to the sender for now.
+			logrus.Infof("refusing incoming mail: %v", result.Verdict.Reason())
+			return errors.New(result.Verdict.Reason())
+		}
+
+		if aliases.IsReverseAlias(to) {
+			return handleReply(apiClient, forwarder, limits, aliases, parsedMail, to, result.Auth)
+		}
+
+		subject, err := new(mime.WordDecoder).DecodeHeader(parsedMail.Header.Get("Subject"))
+		if err != nil {
+			subject = parsedMail.Header.Get("Subject")
 		}
-		subject := parsedMail.Subject
 		//TODO: in the future, let users decide what they want to do with quarantined incoming mail; reject or allow.
-		if result.Quarantine {
+		if result.Verdict.Action == policy.Quarantine {
 			subject = "[SPAM] " + subject
 		}
-		// data.To will always have 1 element.
-		to := data.To[0]
 
 		resp, err := apiClient.GetMask(context.TODO(), &main_api.GetMaskRequest{MaskAddress: to})
 		if err != nil {
@@ -124,26 +314,139 @@ func createHandler(apiClient main_api.MainAPIServiceClient, validator *validatio
 			return nil
 		}
 
-		err = mailer.ForwardMail(parsedMail.From[0].Name, to, resp.Email, subject, parsedMail.HTMLBody, parsedMail.TextBody)
+		content, err := mailer.ParseContent(textproto.MIMEHeader(parsedMail.Header), parsedMail.Body, limits)
 		if err != nil {
-			logrus.Errorf("mailer err: %v", err)
+			logrus.Errorf("error parsing content of incoming email: %v", err)
+			return err
+		}
 
-			//TODO: this shouldn't be a synchronous action, perhaps we can use a message broker here?
-			go func() {
-				_, innerErr := apiClient.IncrementReceivedCount(context.TODO(), &main_api.IncrementReceivedCountRequest{MaskAddress: to})
-				if innerErr != nil {
-					logrus.Error("grpc error(IncrementReceivedCount): ", innerErr)
-				}
-			}()
+		// Replies go to the Reply-To address of the original message when it has one.
+		contact := from
+		if addresses, err := parsedMail.Header.AddressList("Reply-To"); err == nil && len(addresses) > 0 {
+			contact = addresses[0].Address
+		}
+		var replyTo string
+		if contact != "" {
+			alias, err := aliases.Get(to, contact)
+			if err != nil {
+				logrus.Errorf("reverse alias error: %v", err)
+			} else {
+				replyTo = alias.Address
+			}
+		}
+
+		// Users and their filters can see why the message was trusted, or not.
+		headers := mailer.ForwardHeaders(parsedMail.Header, to, replyTo != "")
+		if result.ReceivedSPF != "" {
+			// Received-SPF goes above the Received field of the same hop (RFC 7208 section 9.1).
+			headers = append(headers, mailer.Header{Key: "Received-SPF", Value: result.ReceivedSPF})
+		}
+		headers = append(headers,
+			mailer.Header{Key: "Received", Value: received},
+			loops.Next(parsedMail.Header),
+			mailer.Header{Key: "Authentication-Results", Value: result.AuthenticationResults},
+		)
+		if result.Verdict.Action == policy.Tag || result.Verdict.Action == policy.Quarantine {
+			headers = append(headers, result.Verdict.Headers()...)
+		}
+		err = forwarder.ForwardMail(context.TODO(), &mailer.Message{
+			FromName:              fromName,
+			From:                  to,
+			To:                    resp.Email,
+			ReplyTo:               replyTo,
+			EnvelopeFrom:          data.From,
+			BounceAddress:         verp.Encode(to, messageId),
+			MessageId:             messageId,
+			Subject:               subject,
+			Headers:               headers,
+			AuthenticationResults: result.AuthenticationResults,
+			Content:               *content,
+		})
+		if err != nil {
+			logrus.Errorf("queue err: %v", err)
 			return err
 		}
-		go func() {
-			_, innerErr := apiClient.IncrementForwardedCount(context.TODO(), &main_api.IncrementForwardedCountRequest{MaskAddress: to})
+		logrus.Debugf("Queued mail to: %v from address: %v", resp.Email, to)
+		return nil
+	}
+}
+
+func createDeliveredHandler(apiClient main_api.MainAPIServiceClient, tracker *bounce.Tracker) func(entry *queue.Entry) {
+	return func(entry *queue.Entry) {
+		if entry.Message.Reply || entry.Message.System {
+			return
+		}
+		if err := tracker.Reset(entry.Message.From); err != nil {
+			logrus.Errorf("error resetting bounces: %v", err)
+		}
+		_, err := apiClient.IncrementForwardedCount(context.TODO(), &main_api.IncrementForwardedCountRequest{MaskAddress: entry.Message.From})
+		if err != nil {
+			logrus.Error("DB error(IncrementForwardedCount): ", err)
+		}
+	}
+}
+
+func createFailedHandler(apiClient main_api.MainAPIServiceClient, forwarder mailer.Forwarder, reportBounce bounceReporter, cfg *config.Config) func(entry *queue.Entry, err error) {
+	return func(entry *queue.Entry, err error) {
+		logrus.Errorf("mailer err: %v", err)
+		msg := entry.Message
+		// Reports and notifications have a null envelope sender, nobody is told that they failed.
+		if msg.System {
+			return
+		}
+		if !msg.Reply {
+			_, innerErr := apiClient.IncrementReceivedCount(context.TODO(), &main_api.IncrementReceivedCountRequest{MaskAddress: msg.From})
 			if innerErr != nil {
-				logrus.Error("DB error(IncrementForwardedCount): ", innerErr)
+				logrus.Error("grpc error(IncrementReceivedCount): ", innerErr)
 			}
-		}()
-		logrus.Debugf("Forwarded mail to: %v from address: %v", resp.Email, to)
-		return nil
+		}
+
+		// The sender of a forwarded message only knows the mask, the sender of a reply is the owner of the mask.
+		failure := dsn.Failure{
+			Message:   msg,
+			Recipient: msg.From,
+			Arrival:   entry.CreatedAt,
+			Err:       err,
+			Expired:   !mailer.IsPermanent(err),
+		}
+		// A rejection during delivery is a bounce of the destination just like one that comes back later.
+		if !msg.Reply && !failure.Expired {
+			status, diagnostic := dsn.Classify(failure)
+			// The ID of a later bounce, so the message is counted once. Entries queued without one have only their own.
+			messageId := msg.MessageId
+			if messageId == "" {
+				messageId = entry.ID
+			}
+			reportBounce(msg.From, messageId, &bounce.Report{Recipient: msg.To, Action: "failed", Status: status, Diagnostic: diagnostic})
+		}
+		if dsn.Suppress(msg) {
+			return
+		}
+		to := msg.EnvelopeFrom
+		if msg.Reply {
+			resp, innerErr := apiClient.GetMask(context.TODO(), &main_api.GetMaskRequest{MaskAddress: msg.From})
+			if innerErr != nil {
+				logrus.Errorf("grpc error(GetMask): %v", innerErr)
+				return
+			}
+			failure.Recipient = msg.To
+			to = resp.Email
+		}
+		notification := dsn.Build(cfg.Hostname, cfg.Mailer.DaemonAddress, to, failure)
+		if innerErr := forwarder.ForwardMail(context.TODO(), notification); innerErr != nil {
+			logrus.Errorf("error queueing delivery status notification: %v", innerErr)
+		}
+	}
+}
+
+// disposition is the DMARC disposition (RFC 7489 section 7.2) the action of the policy amounts to.
+func disposition(action policy.Action) dmarc.Policy {
+	switch action {
+	case policy.Reject:
+		return dmarc.PolicyReject
+	case policy.Quarantine:
+		return dmarc.PolicyQuarantine
+	default:
+		return dmarc.PolicyNone
 	}
 }
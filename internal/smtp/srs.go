@@ -0,0 +1,75 @@
+package smtp
+
+import (
+	"context"
+	"mime"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/maskrapp/relay/internal/mailer"
+	main_api "github.com/maskrapp/relay/internal/pb/main_api/v1"
+	"github.com/maskrapp/relay/internal/srs"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// acceptSRSBounce accepts mail to an SRS address from any sender, including the null sender, as long as the address is genuine.
+func acceptSRSBounce(rewriter *srs.Rewriter, to string) bool {
+	if _, err := rewriter.Reverse(to); err != nil {
+		logrus.Debugf("rejecting mail to SRS address %v: %v", to, err)
+		return false
+	}
+	return true
+}
+
+// handleSRSBounce passes a bounce of a reply on to the owner of the mask that sent it. Replies are the only messages
+// delivered with an SRS envelope sender, so the reversed address is a mask.
+func handleSRSBounce(apiClient main_api.MainAPIServiceClient, forwarder mailer.Forwarder, limits mailer.Limits, rewriter *srs.Rewriter, parsedMail *mail.Message, to string) error {
+	mask, err := rewriter.Reverse(to)
+	if err != nil {
+		return err
+	}
+	resp, err := apiClient.GetMask(context.TODO(), &main_api.GetMaskRequest{MaskAddress: mask})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			logrus.Debugf("discarding bounce to SRS address %v: %v is not a mask", to, mask)
+			return nil
+		}
+		logrus.Errorf("grpc error(GetMask): %v", err)
+		return err
+	}
+	if !resp.Enabled {
+		return nil
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsedMail.Header.Get("Subject"))
+	if err != nil {
+		subject = parsedMail.Header.Get("Subject")
+	}
+	content, err := mailer.ParseContent(textproto.MIMEHeader(parsedMail.Header), parsedMail.Body, limits)
+	if err != nil {
+		logrus.Errorf("error parsing content of bounce: %v", err)
+		return err
+	}
+	var fromName string
+	if addresses, err := parsedMail.Header.AddressList("From"); err == nil && len(addresses) > 0 {
+		fromName = addresses[0].Name
+	}
+	// The bounce keeps its null envelope sender, so it never causes another notification.
+	err = forwarder.ForwardMail(context.TODO(), &mailer.Message{
+		FromName: fromName,
+		From:     mask,
+		To:       resp.Email,
+		Subject:  subject,
+		System:   true,
+		Headers:  mailer.ForwardHeaders(parsedMail.Header, mask, false),
+		Content:  *content,
+	})
+	if err != nil {
+		logrus.Errorf("queue err: %v", err)
+		return err
+	}
+	logrus.Debugf("Queued bounce of a reply from mask %v to: %v", mask, resp.Email)
+	return nil
+}
@@ -0,0 +1,170 @@
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sender Rewriting Scheme, as described in https://www.libsrs2.org/srs/srs.pdf.
+// Forwarded mail is sent with an envelope sender on our own domain, so that SPF passes at the destination,
+// while the original sender can still be recovered when the message bounces.
+
+const (
+	timestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timestampSlots    = 1024
+	hashLength        = 4
+	separator         = "="
+	// MinSecretLength is the shortest secret New accepts, anyone who guesses the secret can forge bounces.
+	MinSecretLength = 16
+)
+
+var (
+	ErrNotSRS          = errors.New("address is not an SRS address")
+	ErrInvalidHash     = errors.New("SRS hash does not match")
+	ErrExpired         = errors.New("SRS timestamp has expired")
+	ErrInvalidAddress  = errors.New("invalid address")
+	ErrInvalidEncoding = errors.New("malformed SRS address")
+	ErrWeakSecret      = fmt.Errorf("SRS secret must be at least %v characters", MinSecretLength)
+)
+
+type Rewriter struct {
+	secret []byte
+	domain string
+	maxAge time.Duration
+}
+
+// New creates a Rewriter that signs addresses with secret and rewrites them to domain.
+func New(secret, domain string) (*Rewriter, error) {
+	if len(secret) < MinSecretLength {
+		return nil, ErrWeakSecret
+	}
+	return &Rewriter{
+		secret: []byte(secret),
+		domain: domain,
+		maxAge: 21 * 24 * time.Hour,
+	}, nil
+}
+
+// IsSRSAddress reports whether address is an SRS0 or SRS1 address on the rewriter's domain, which says nothing about
+// whether it is genuine.
+func (r *Rewriter) IsSRSAddress(address string) bool {
+	local, domain, ok := splitAddress(address)
+	if !ok || !strings.EqualFold(domain, r.domain) || len(local) <= 4 || !isSeparator(local[4]) {
+		return false
+	}
+	prefix := strings.ToUpper(local[:4])
+	return prefix == "SRS0" || prefix == "SRS1"
+}
+
+// Forward rewrites address to an SRS address on the rewriter's domain.
+// Addresses that are already SRS addresses are rewritten to SRS1 so the chain does not grow.
+func (r *Rewriter) Forward(address string) (string, error) {
+	local, domain, ok := splitAddress(address)
+	if !ok {
+		return "", ErrInvalidAddress
+	}
+	if strings.EqualFold(domain, r.domain) {
+		return address, nil
+	}
+	upper := strings.ToUpper(local)
+	switch {
+	case strings.HasPrefix(upper, "SRS0") && len(local) > 4 && isSeparator(local[4]):
+		// SRS1=HHHH=first-hop-domain==opaque-part
+		hash := r.hash(domain, local[4:])
+		return fmt.Sprintf("SRS1=%v=%v=%v@%v", hash, domain, local[4:], r.domain), nil
+	case strings.HasPrefix(upper, "SRS1") && len(local) > 4 && isSeparator(local[4]):
+		parts := strings.SplitN(local[5:], separator, 3)
+		if len(parts) != 3 {
+			return "", ErrInvalidEncoding
+		}
+		hash := r.hash(parts[1], parts[2])
+		return fmt.Sprintf("SRS1=%v=%v=%v@%v", hash, parts[1], parts[2], r.domain), nil
+	}
+	timestamp := r.timestamp(time.Now())
+	hash := r.hash(timestamp, domain, local)
+	return fmt.Sprintf("SRS0=%v=%v=%v=%v@%v", hash, timestamp, domain, local, r.domain), nil
+}
+
+// Reverse recovers the original address from an SRS address created by Forward.
+func (r *Rewriter) Reverse(address string) (string, error) {
+	local, _, ok := splitAddress(address)
+	if !ok {
+		return "", ErrInvalidAddress
+	}
+	upper := strings.ToUpper(local)
+	switch {
+	case strings.HasPrefix(upper, "SRS0") && len(local) > 4 && isSeparator(local[4]):
+		parts := strings.SplitN(local[5:], separator, 4)
+		if len(parts) != 4 {
+			return "", ErrInvalidEncoding
+		}
+		hash, timestamp, domain, user := parts[0], parts[1], parts[2], parts[3]
+		if !r.validHash(hash, timestamp, domain, user) {
+			return "", ErrInvalidHash
+		}
+		if !r.validTimestamp(timestamp, time.Now()) {
+			return "", ErrExpired
+		}
+		return user + "@" + domain, nil
+	case strings.HasPrefix(upper, "SRS1") && len(local) > 4 && isSeparator(local[4]):
+		parts := strings.SplitN(local[5:], separator, 3)
+		if len(parts) != 3 {
+			return "", ErrInvalidEncoding
+		}
+		hash, domain, opaque := parts[0], parts[1], parts[2]
+		if !r.validHash(hash, domain, opaque) {
+			return "", ErrInvalidHash
+		}
+		return "SRS0" + opaque + "@" + domain, nil
+	}
+	return "", ErrNotSRS
+}
+
+func (r *Rewriter) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, r.secret)
+	for _, v := range parts {
+		mac.Write([]byte(strings.ToLower(v)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (r *Rewriter) validHash(hash string, parts ...string) bool {
+	return hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(r.hash(parts...))))
+}
+
+func (r *Rewriter) timestamp(t time.Time) string {
+	days := (t.Unix() / 86400) % timestampSlots
+	return string([]byte{timestampAlphabet[days>>5], timestampAlphabet[days&31]})
+}
+
+func (r *Rewriter) validTimestamp(timestamp string, now time.Time) bool {
+	if len(timestamp) != 2 {
+		return false
+	}
+	high := strings.IndexByte(timestampAlphabet, strings.ToUpper(timestamp)[0])
+	low := strings.IndexByte(timestampAlphabet, strings.ToUpper(timestamp)[1])
+	if high == -1 || low == -1 {
+		return false
+	}
+	then := int64(high<<5 | low)
+	today := (now.Unix() / 86400) % timestampSlots
+	age := (today - then + timestampSlots) % timestampSlots
+	return time.Duration(age)*24*time.Hour <= r.maxAge
+}
+
+func splitAddress(address string) (string, string, bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+func isSeparator(b byte) bool {
+	return b == '=' || b == '+' || b == '-'
+}
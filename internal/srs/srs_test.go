@@ -0,0 +1,54 @@
+package srs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/srs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAndReverse(t *testing.T) {
+	r, err := srs.New("0123456789abcdef", "srs.maskr.app")
+	assert.NoError(t, err)
+
+	rewritten, err := r.Forward("alice@example.com")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rewritten, "SRS0="))
+	assert.True(t, strings.HasSuffix(rewritten, "=example.com=alice@srs.maskr.app"))
+	assert.True(t, r.IsSRSAddress(rewritten))
+	assert.False(t, r.IsSRSAddress("alice@srs.maskr.app"))
+	assert.False(t, r.IsSRSAddress(strings.Replace(rewritten, "srs.maskr.app", "example.net", 1)))
+
+	original, err := r.Reverse(rewritten)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", original)
+
+	other, err := srs.New("fedcba9876543210", "srs.maskr.app")
+	assert.NoError(t, err)
+	_, err = other.Reverse(rewritten)
+	assert.ErrorIs(t, err, srs.ErrInvalidHash)
+
+	_, err = r.Reverse("alice@example.com")
+	assert.ErrorIs(t, err, srs.ErrNotSRS)
+
+	_, err = srs.New("secret", "srs.maskr.app")
+	assert.ErrorIs(t, err, srs.ErrWeakSecret)
+}
+
+func TestForwardSRS0(t *testing.T) {
+	first, err := srs.New("first secret 0123", "forwarder.example")
+	assert.NoError(t, err)
+	second, err := srs.New("second secret 012", "srs.maskr.app")
+	assert.NoError(t, err)
+
+	hop, err := first.Forward("alice@example.com")
+	assert.NoError(t, err)
+	rewritten, err := second.Forward(hop)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rewritten, "SRS1="))
+
+	reversed, err := second.Reverse(rewritten)
+	assert.NoError(t, err)
+	assert.Equal(t, hop, reversed)
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Store is a small persistent key-value store for state the relay keeps locally.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// Keys returns the keys that start with prefix, in lexical order.
+	Keys(prefix string) ([]string, error)
+}
+
+// maxNameLength keeps file names well below the 255 bytes most file systems allow.
+const maxNameLength = 200
+
+// hashedPrefix starts the names of files whose key is too long to be encoded in the name. Such a file is named
+// after the SHA-256 hash of its key and holds the encoded key on its first line, before the value.
+const hashedPrefix = "~"
+
+// FileStore keeps every key in its own file inside a directory. Writes are atomic, so a crash never leaves a partial value behind.
+type FileStore struct {
+	dir   string
+	mutex sync.RWMutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file of key, and whether its name is a hash.
+func (s *FileStore) path(key string) (string, bool) {
+	name := base64.RawURLEncoding.EncodeToString([]byte(key))
+	if len(name) <= maxNameLength {
+		return filepath.Join(s.dir, name), false
+	}
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hashedPrefix+hex.EncodeToString(hash[:])), true
+}
+
+func (s *FileStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	path, hashed := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil || !hashed {
+		return data, err
+	}
+	stored, value, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || string(stored) != base64.RawURLEncoding.EncodeToString([]byte(key)) {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *FileStore) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path, hashed := s.path(key)
+	if hashed {
+		value = append([]byte(base64.RawURLEncoding.EncodeToString([]byte(key))+"\n"), value...)
+	}
+	file, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *FileStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path, _ := s.path(key)
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, v := range entries {
+		if strings.HasPrefix(v.Name(), ".") {
+			continue
+		}
+		name := v.Name()
+		if strings.HasPrefix(name, hashedPrefix) {
+			if name, err = s.storedKey(name); err != nil {
+				continue
+			}
+		}
+		key, err := base64.RawURLEncoding.DecodeString(name)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(string(key), prefix) {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// storedKey reads the encoded key from the first line of a file with a hashed name.
+func (s *FileStore) storedKey(name string) (string, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// MemoryStore is a Store that does not persist anything, for tests and development.
+type MemoryStore struct {
+	values map[string][]byte
+	mutex  sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemoryStore) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := make([]string, 0)
+	for k := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,44 @@
+package store_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStoreLongKeys(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	short := "reverse/alias@maskr.app"
+	long := "reverse/" + strings.Repeat("a", 300) + "@example.com"
+	assert.NoError(t, s.Put(short, []byte("first")))
+	assert.NoError(t, s.Put(long, []byte("second\nline")))
+
+	value, err := s.Get(long)
+	assert.NoError(t, err)
+	assert.Equal(t, "second\nline", string(value))
+	value, err = s.Get(short)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(value))
+
+	keys, err := s.Keys("reverse/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{long, short}, keys)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, v := range entries {
+		assert.LessOrEqual(t, len(v.Name()), 255)
+	}
+
+	assert.NoError(t, s.Delete(long))
+	_, err = s.Get(long)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	keys, err = s.Keys("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{short}, keys)
+}
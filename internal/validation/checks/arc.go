@@ -0,0 +1,103 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/arc"
+	"github.com/maskrapp/relay/internal/check"
+)
+
+// ArcCheck validates the ARC chain of mail that reached us through mailing lists and other forwarders.
+// When the newest set comes from a trusted sealer that saw DMARC pass, DmarcCheck may override its own fail.
+type ArcCheck struct {
+	Verifier       *arc.Verifier
+	TrustedSealers []string
+}
+
+func (c ArcCheck) Name() string {
+	return "arc"
+}
+
+func (c ArcCheck) Provides() []check.Part {
+	return []check.Part{check.PartARC}
+}
+
+func (c ArcCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
+	resultChan := make(chan check.CheckResult, 1)
+	go func() {
+		result := c.runCheck(ctx, values)
+		resultChan <- result
+	}()
+	select {
+	case <-ctx.Done():
+		return check.CheckResult{
+			Success: false,
+			Message: "check was cancelled by context",
+		}
+	case result := <-resultChan:
+		return result
+	}
+}
+
+func (c ArcCheck) runCheck(ctx context.Context, values check.CheckValues) check.CheckResult {
+	verification := c.Verifier.Verify(ctx, []byte(values.MailData))
+	result := &check.ARCResult{Value: authres.ResultValue(verification.Status)}
+	if verification.Status != arc.StatusPass {
+		message := "no ARC chain"
+		if verification.Err != nil {
+			message = fmt.Sprintf("ARC chain failed: %v", verification.Err)
+		}
+		return check.CheckResult{
+			Message: message,
+			Success: verification.Status == arc.StatusNone,
+			Symbols: []check.Symbol{arcSymbol(verification.Status)},
+			Auth:    check.AuthResults{ARC: result},
+		}
+	}
+	newest := verification.Sets[len(verification.Sets)-1]
+	result.Sealer = newest.Domain
+	result.Override = c.isTrusted(newest.Domain) && sawDmarcPass(newest, values.HeaderFrom)
+	return check.CheckResult{
+		Message: fmt.Sprintf("ARC chain passed, sealed by %v", newest.Domain),
+		Success: true,
+		Symbols: []check.Symbol{arcSymbol(verification.Status)},
+		Auth:    check.AuthResults{ARC: result},
+	}
+}
+
+func arcSymbol(status arc.Status) check.Symbol {
+	switch status {
+	case arc.StatusPass:
+		return check.Symbol{Name: "ARC_PASS", Score: 0}
+	case arc.StatusFail:
+		return check.Symbol{Name: "ARC_FAIL", Score: 1}
+	default:
+		return check.Symbol{Name: "ARC_NONE", Score: 0}
+	}
+}
+
+func (c ArcCheck) isTrusted(domain string) bool {
+	for _, v := range c.TrustedSealers {
+		if strings.EqualFold(v, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// sawDmarcPass reports whether the sealer recorded DMARC pass for the domain the message claims to be from.
+func sawDmarcPass(set arc.Set, headerFrom string) bool {
+	split := strings.Split(headerFrom, "@")
+	if len(split) != 2 {
+		return false
+	}
+	for _, v := range set.Results() {
+		if result, ok := v.(*authres.DMARCResult); ok && result.Value == authres.ResultPass && strings.EqualFold(result.From, split[1]) {
+			return true
+		}
+	}
+	return false
+}
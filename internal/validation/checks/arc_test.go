@@ -0,0 +1,54 @@
+package checks_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/arc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/validation/checks"
+	"github.com/stretchr/testify/assert"
+)
+
+// sealedByList returns a message as a mailing list at lists.example.org would forward it.
+func sealedByList(t *testing.T) (string, *resolver.Zone) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	sealer, err := arc.NewSealer("lists.example.org", "arc", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.NoError(t, err)
+	message := "From: sender@example.com\r\nTo: list@lists.example.org\r\nSubject: [list] Hello\r\n\r\nHello\r\n"
+	seal, err := sealer.Seal([]byte(message), "mx.lists.example.org; dmarc=pass header.from=example.com")
+	assert.NoError(t, err)
+	return string(seal) + message, &resolver.Zone{TXT: map[string][]string{
+		"arc._domainkey.lists.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)},
+	}}
+}
+
+func TestArcCheck(t *testing.T) {
+	message, zone := sealedByList(t)
+	values := check.CheckValues{HeaderFrom: "sender@example.com", MailData: message}
+
+	trusted := checks.ArcCheck{Verifier: &arc.Verifier{Resolver: zone}, TrustedSealers: []string{"lists.example.org"}}
+	result := trusted.Validate(context.Background(), values)
+	assert.True(t, result.Success)
+	assert.Equal(t, "lists.example.org", result.Auth.ARC.Sealer)
+	assert.True(t, result.Auth.ARC.Override)
+
+	untrusted := checks.ArcCheck{Verifier: &arc.Verifier{Resolver: zone}}
+	result = untrusted.Validate(context.Background(), values)
+	assert.EqualValues(t, authres.ResultPass, result.Auth.ARC.Value)
+	assert.False(t, result.Auth.ARC.Override)
+
+	values.HeaderFrom = "sender@other.example"
+	result = trusted.Validate(context.Background(), values)
+	assert.False(t, result.Auth.ARC.Override, "the sealer did not vouch for this domain")
+}
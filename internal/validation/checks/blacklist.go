@@ -3,18 +3,21 @@ package checks
 import (
 	"context"
 	"fmt"
-	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/rbl"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/sirupsen/logrus"
 )
 
 type BlacklistCheck struct {
-	List []string
+	List []rbl.List
+	// Resolver queries the lists, resolver.Default when nil.
+	Resolver resolver.Resolver
 }
 
 func (c BlacklistCheck) Name() string {
@@ -24,7 +27,7 @@ func (c BlacklistCheck) Name() string {
 func (c BlacklistCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
 	resultChan := make(chan check.CheckResult, 1)
 	go func() {
-		result := c.runCheck(values)
+		result := c.runCheck(ctx, values)
 		resultChan <- result
 	}()
 	select {
@@ -38,20 +41,27 @@ func (c BlacklistCheck) Validate(ctx context.Context, values check.CheckValues)
 	}
 }
 
-func (c BlacklistCheck) runCheck(values check.CheckValues) check.CheckResult {
-	reversedIp := c.reverseIp(values.Ip)
+func (c BlacklistCheck) runCheck(ctx context.Context, values check.CheckValues) check.CheckResult {
+	// IPv6 addresses are queried nibble by nibble (RFC 5782 section 2.4).
+	reversedIp := resolver.ReverseIP(values.Ip)
+	lists := make([]string, 0, len(c.List))
+	for _, v := range c.List {
+		if v.Covers(values.Ip) {
+			lists = append(lists, v.Zone)
+		}
+	}
 	queries := make([]lookupResult, 0)
 	mutex := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	start := time.Now()
 	blacklisted := atomic.Bool{}
-	wg.Add(len(c.List))
-	for _, v := range c.List {
+	wg.Add(len(lists))
+	for _, v := range lists {
 		go func(server string) {
 			defer wg.Done()
-			result := c.query(reversedIp, server)
+			result := c.query(ctx, reversedIp, server)
 			if result.Error != nil {
-				logrus.Info("(blcheck) received unexpected error: %v", result.Error)
+				logrus.Infof("(blcheck) received unexpected error: %v", result.Error)
 			}
 			if result.Exists {
 				blacklisted.Store(true)
@@ -71,12 +81,17 @@ func (c BlacklistCheck) runCheck(values check.CheckValues) check.CheckResult {
 		}
 	}
 	reasons := make([]string, 0)
+	// Every list the address is on adds to the score.
+	symbols := make([]check.Symbol, 0)
 	for _, v := range queries {
 		reasons = append(reasons, v.Reasons...)
+		if v.Exists {
+			symbols = append(symbols, check.Symbol{Name: "RBL_LISTED", Score: 8})
+		}
 	}
 	return check.CheckResult{
-		Reject:  true,
 		Message: fmt.Sprintf("IP address is blacklisted for the following reason(s): %v", reasons),
+		Symbols: symbols,
 	}
 }
 
@@ -87,11 +102,12 @@ type lookupResult struct {
 	Error   error
 }
 
-func (c BlacklistCheck) query(reversedIp, server string) lookupResult {
+func (c BlacklistCheck) query(ctx context.Context, reversedIp, server string) lookupResult {
 	address := fmt.Sprintf("%v.%v", reversedIp, server)
-	res, err := net.LookupHost(address)
+	dns := resolver.OrDefault(c.Resolver)
+	res, err := dns.LookupIPAddr(ctx, address)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such host") {
+		if resolver.IsNotFound(err) {
 			return lookupResult{
 				Address: address,
 			}
@@ -100,25 +116,17 @@ func (c BlacklistCheck) query(reversedIp, server string) lookupResult {
 	}
 	result := lookupResult{Address: address}
 	for _, v := range res {
-		if strings.HasPrefix(v, "127.0.0.") {
+		if strings.HasPrefix(v.IP.String(), "127.0.0.") {
 			result.Exists = true
 		} else {
-			logrus.Info("found unexpected record %v in blacklist dns query for address: %v", v, address)
+			logrus.Infof("found unexpected record %v in blacklist dns query for address: %v", v, address)
 		}
 	}
 	if result.Exists {
-		records, _ := net.LookupTXT(address)
+		records, _ := dns.LookupTXT(ctx, address)
 		for _, v := range records {
 			result.Reasons = append(result.Reasons, v)
 		}
 	}
 	return result
 }
-
-func (c BlacklistCheck) reverseIp(ip net.IP) string {
-	octets := strings.Split(ip.String(), ".")
-	for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
-		octets[i], octets[j] = octets[j], octets[i]
-	}
-	return strings.Join(octets, ".")
-}
@@ -0,0 +1,51 @@
+package checks_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/rbl"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/validation/checks"
+	"github.com/stretchr/testify/assert"
+)
+
+const listedIPv6 = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"
+
+func TestBlacklist(t *testing.T) {
+	listed := []net.IP{net.ParseIP("127.0.0.2")}
+	c := checks.BlacklistCheck{
+		List: []rbl.List{
+			{Zone: "bl.example.org", IPv4: true, IPv6: true},
+			{Zone: "v4.example.org", IPv4: true},
+		},
+		Resolver: &resolver.Zone{
+			IP: map[string][]net.IP{
+				"1.2.0.192.bl.example.org":     listed,
+				listedIPv6 + ".bl.example.org": listed,
+				listedIPv6 + ".v4.example.org": listed,
+			},
+			TXT: map[string][]string{
+				"1.2.0.192.bl.example.org":     {"listed for spam"},
+				listedIPv6 + ".bl.example.org": {"listed for IPv6 spam"},
+			},
+		},
+	}
+
+	result := c.Validate(context.Background(), check.CheckValues{Ip: net.ParseIP("192.0.2.1")})
+	assert.Equal(t, []check.Symbol{{Name: "RBL_LISTED", Score: 8}}, result.Symbols)
+	assert.Contains(t, result.Message, "listed for spam")
+
+	result = c.Validate(context.Background(), check.CheckValues{Ip: net.ParseIP("192.0.2.2")})
+	assert.True(t, result.Success)
+
+	// The IPv4 only list is not asked about IPv6 addresses.
+	result = c.Validate(context.Background(), check.CheckValues{Ip: net.ParseIP("2001:db8::1")})
+	assert.Equal(t, []check.Symbol{{Name: "RBL_LISTED", Score: 8}}, result.Symbols)
+	assert.Contains(t, result.Message, "listed for IPv6 spam")
+
+	result = c.Validate(context.Background(), check.CheckValues{Ip: net.ParseIP("2001:db8::2")})
+	assert.True(t, result.Success)
+}
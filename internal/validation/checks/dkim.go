@@ -2,22 +2,60 @@ package checks
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/arc"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
 )
 
-type DkimCheck struct{}
+// DkimPolicy decides what a signature that verified but has a weakness counts for.
+type DkimPolicy string
+
+const (
+	// DkimAllow accepts the signature as is.
+	DkimAllow DkimPolicy = "allow"
+	// DkimPenalize accepts the signature, but adds to the score of the message.
+	DkimPenalize DkimPolicy = "penalize"
+	// DkimFail does not accept the signature, its result becomes policy (RFC 8601 section 2.7.1).
+	DkimFail DkimPolicy = "fail"
+)
+
+type DkimCheck struct {
+	// MinRSABits is the smallest RSA key that is not weak. Keys below 1024 bits never verify (RFC 8301 section 3.2).
+	MinRSABits int
+	// WeakKeys applies to signatures made with an RSA key below MinRSABits.
+	WeakKeys DkimPolicy
+	// BodyLength applies to signatures with an l= tag, which allow content to be appended to the signed body.
+	BodyLength DkimPolicy
+	// Resolver looks up the signing keys, resolver.Default when nil.
+	Resolver resolver.Resolver
+}
 
 func (c DkimCheck) Name() string {
   return "dkim"
 }
 
+func (c DkimCheck) Provides() []check.Part {
+	return []check.Part{check.PartDKIM}
+}
+
 func (c DkimCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
 	resultChan := make(chan check.CheckResult, 1)
 	go func() {
-		result := c.runCheck(values)
+		result := c.runCheck(ctx, values)
 		resultChan <- result
 	}()
 	select {
@@ -31,44 +69,211 @@ func (c DkimCheck) Validate(ctx context.Context, values check.CheckValues) check
 	}
 }
 
-func (c DkimCheck) runCheck(values check.CheckValues) check.CheckResult {
-	verifications, err := dkim.Verify(strings.NewReader(values.MailData))
+func (c DkimCheck) runCheck(ctx context.Context, values check.CheckValues) check.CheckResult {
+	keys := &dkimKeys{resolver: resolver.OrDefault(c.Resolver), records: make(map[string]string)}
+	verifications, err := dkim.VerifyWithOptions(strings.NewReader(values.MailData), &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return keys.LookupTXT(ctx, name)
+		},
+	})
 	if err != nil {
 		return check.CheckResult{
 			Message: err.Error(),
 			Success: false,
-			Data: map[string]any{
-				"dkim_pass": false,
-			},
+			Symbols: []check.Symbol{{Name: "DKIM_INVALID", Score: 2}},
+			Auth:    check.AuthResults{DKIM: &check.DKIMResult{Err: err}},
 		}
 	}
 	if len(verifications) == 0 {
 		return check.CheckResult{
 			Message: "Domain does not have any DKIM records",
 			Success: false,
-			Data: map[string]any{
-				"dkim_pass": false,
-			},
+			Symbols: []check.Symbol{{Name: "DKIM_NONE", Score: 1}},
+			Auth:    check.AuthResults{DKIM: &check.DKIMResult{}},
 		}
 	}
-	for _, v := range verifications {
-		if v.Err == nil {
-			return check.CheckResult{
-				Message: "Found valid DKIM record",
-				Success: true,
-				Data: map[string]any{
-					"dkim_pass":   true,
-					"dkim_domain": v.Domain,
-				},
+	_, fromDomain, _ := strings.Cut(values.HeaderFrom, "@")
+	result := &check.DKIMResult{}
+	var symbols []check.Symbol
+	var descriptions []string
+	// dkim.Verify keeps the order of the signature fields, but does not report most of their tags.
+	tags := dkimSignatureTags(values.MailData)
+	for i, v := range verifications {
+		signature := check.DKIMSignature{Value: dkimResultValue(v.Err), Domain: v.Domain, Identifier: v.Identifier, Err: v.Err}
+		if i < len(tags) {
+			signature.Selector = tags[i]["s"]
+			signature.Algorithm = tags[i]["a"]
+			if l, err := strconv.ParseInt(tags[i]["l"], 10, 64); err == nil {
+				signature.BodyLength = &l
+				// dkim.Verify fails every signature with an l= tag, so those are verified again with the same checks
+				// except for the tag itself, and the policy decides.
+				verifier := &arc.Verifier{Resolver: keys}
+				signature.Err = verifier.VerifyDKIM(ctx, []byte(values.MailData), i)
+				signature.Value = bodyLengthResultValue(signature.Err)
 			}
 		}
+		signature.KeyBits = keys.bits(signature.Selector + "._domainkey." + signature.Domain)
+		signature.ThirdParty = !isAligned(fromDomain, signature.Domain, dmarc.AlignmentRelaxed)
+		if signature.Value == authres.ResultPass {
+			if strings.HasPrefix(signature.Algorithm, "rsa-") && signature.KeyBits > 0 && signature.KeyBits < c.MinRSABits {
+				symbols = c.apply(c.WeakKeys, &signature, check.Symbol{Name: "DKIM_WEAK_KEY", Score: 2}, fmt.Sprintf("%v-bit key", signature.KeyBits), symbols)
+			}
+			if signature.BodyLength != nil {
+				symbols = c.apply(c.BodyLength, &signature, check.Symbol{Name: "DKIM_BODY_LENGTH", Score: 1.5}, "body length limit", symbols)
+			}
+		}
+		descriptions = append(descriptions, describeSignature(signature))
+		result.Signatures = append(result.Signatures, signature)
+	}
+	message := strings.Join(descriptions, ", ")
+	if len(result.Passing()) > 0 {
+		return check.CheckResult{
+			Message: message,
+			Success: true,
+			Symbols: append([]check.Symbol{{Name: "DKIM_PASS", Score: 0}}, symbols...),
+			Auth:    check.AuthResults{DKIM: result},
+		}
 	}
 
 	return check.CheckResult{
-		Message: "DKIM check failed",
+		Message: message,
 		Success: false,
-		Data: map[string]any{
-			"dkim_pass": false,
-		},
+		Symbols: append([]check.Symbol{{Name: "DKIM_FAIL", Score: 2}}, symbols...),
+		Auth:    check.AuthResults{DKIM: result},
+	}
+}
+
+// apply applies policy to a passing signature with a weakness, and returns symbols with the symbol for it added once.
+func (c DkimCheck) apply(policy DkimPolicy, signature *check.DKIMSignature, symbol check.Symbol, reason string, symbols []check.Symbol) []check.Symbol {
+	switch policy {
+	case DkimFail:
+		signature.Value = authres.ResultPolicy
+		signature.Reason = reason
+		symbol.Score = 0
+	case DkimPenalize:
+	default:
+		return symbols
+	}
+	for _, v := range symbols {
+		if v.Name == symbol.Name {
+			return symbols
+		}
+	}
+	return append(symbols, symbol)
+}
+
+func describeSignature(signature check.DKIMSignature) string {
+	description := fmt.Sprintf("%v d=%v s=%v a=%v", signature.Value, signature.Domain, signature.Selector, signature.Algorithm)
+	if signature.KeyBits > 0 {
+		description += fmt.Sprintf(" %v-bit", signature.KeyBits)
+	}
+	if signature.BodyLength != nil {
+		description += fmt.Sprintf(" l=%v", *signature.BodyLength)
+	}
+	if signature.ThirdParty {
+		description += " third-party"
+	}
+	return description
+}
+
+// dkimKeys remembers the key records looked up while verifying, to tell the key sizes afterwards.
+type dkimKeys struct {
+	resolver resolver.Resolver
+	mutex    sync.Mutex
+	records  map[string]string
+}
+
+func (k *dkimKeys) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, err := k.resolver.LookupTXT(ctx, name)
+	if err == nil {
+		k.mutex.Lock()
+		k.records[strings.ToLower(name)] = strings.Join(txts, "")
+		k.mutex.Unlock()
+	}
+	return txts, err
+}
+
+// bits returns the size of the key published at name.
+func (k *dkimKeys) bits(name string) int {
+	k.mutex.Lock()
+	record, ok := k.records[strings.ToLower(name)]
+	k.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+	tags := parseDkimTags(record)
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(data) == 0 {
+		return 0
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(data)
+			if err != nil {
+				return 0
+			}
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey.N.BitLen()
+		}
+		return 0
+	case "ed25519":
+		return len(data) * 8
+	default:
+		return 0
+	}
+}
+
+// dkimSignatureTags returns the tags of the DKIM-Signature fields of the message, in order.
+func dkimSignatureTags(mailData string) []map[string]string {
+	message, err := mail.ReadMessage(strings.NewReader(mailData))
+	if err != nil {
+		return nil
+	}
+	var tags []map[string]string
+	for _, field := range message.Header["Dkim-Signature"] {
+		tags = append(tags, parseDkimTags(field))
+	}
+	return tags
+}
+
+// parseDkimTags parses a tag list (RFC 6376 section 3.2), whitespace inside values is dropped.
+func parseDkimTags(list string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(list, ";") {
+		key, value, ok := strings.Cut(tag, "=")
+		if ok {
+			tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(value), "")
+		}
+	}
+	return tags
+}
+
+// bodyLengthResultValue is the result of a signature with an l= tag verified again, where only a failed lookup is
+// temporary.
+func bodyLengthResultValue(err error) authres.ResultValue {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return authres.ResultPass
+	case errors.As(err, &dnsErr) && !dnsErr.IsNotFound:
+		return authres.ResultTempError
+	default:
+		return authres.ResultFail
+	}
+}
+
+func dkimResultValue(err error) authres.ResultValue {
+	switch {
+	case err == nil:
+		return authres.ResultPass
+	case dkim.IsTempFail(err):
+		return authres.ResultTempError
+	case dkim.IsPermFail(err):
+		return authres.ResultPermError
+	default:
+		return authres.ResultFail
 	}
 }
@@ -0,0 +1,128 @@
+package checks_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/validation/checks"
+	"github.com/stretchr/testify/assert"
+)
+
+const dkimMessage = "From: sender@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"
+
+func rsaKey(t *testing.T, bits int) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return key, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+// signWithBodyLength signs dkimMessage with an l= tag covering only the first line of the body, which the dkim
+// package cannot do. tags are added to the signature, h= lists the signed fields.
+func signWithBodyLength(t *testing.T, key *rsa.PrivateKey, tags string) string {
+	bodyHash := sha256.Sum256([]byte("Hello"))
+	value := "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=long; " + tags + "; l=5; bh=" +
+		base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	var input string
+	if strings.Contains(tags, "h=from") {
+		input += "from:sender@example.com\r\n"
+	}
+	input += "subject:Hello\r\ndkim-signature:" + value
+	hash := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	assert.NoError(t, err)
+	return "DKIM-Signature: " + value + base64.StdEncoding.EncodeToString(signature) + "\r\n" + dkimMessage
+}
+
+func TestDkimSignatures(t *testing.T) {
+	key, record := rsaKey(t, 1024)
+	signed := &bytes.Buffer{}
+	err := dkim.Sign(signed, strings.NewReader(dkimMessage), &dkim.SignOptions{Domain: "example.com", Selector: "weak", Signer: key})
+	assert.NoError(t, err)
+	zone := &resolver.Zone{TXT: map[string][]string{"weak._domainkey.example.com": {record}}}
+	values := check.CheckValues{HeaderFrom: "sender@example.com", MailData: signed.String()}
+
+	penalize := checks.DkimCheck{MinRSABits: 2048, WeakKeys: checks.DkimPenalize, Resolver: zone}
+	result := penalize.Validate(context.Background(), values)
+	assert.Equal(t, []check.Symbol{{Name: "DKIM_PASS", Score: 0}, {Name: "DKIM_WEAK_KEY", Score: 2}}, result.Symbols)
+	signature := result.Auth.DKIM.Signatures[0]
+	assert.Equal(t, "weak", signature.Selector)
+	assert.Equal(t, "rsa-sha256", signature.Algorithm)
+	assert.Equal(t, 1024, signature.KeyBits)
+	assert.False(t, signature.ThirdParty)
+
+	fail := checks.DkimCheck{MinRSABits: 2048, WeakKeys: checks.DkimFail, Resolver: zone}
+	result = fail.Validate(context.Background(), values)
+	assert.Equal(t, "DKIM_FAIL", result.Symbols[0].Name)
+	assert.EqualValues(t, authres.ResultPolicy, result.Auth.DKIM.Signatures[0].Value)
+	assert.Equal(t, "1024-bit key", result.Auth.DKIM.Signatures[0].Reason)
+
+	values.HeaderFrom = "sender@other.example"
+	result = penalize.Validate(context.Background(), values)
+	assert.True(t, result.Auth.DKIM.Signatures[0].ThirdParty)
+}
+
+func TestDkimBodyLength(t *testing.T) {
+	key, record := rsaKey(t, 1024)
+	values := check.CheckValues{HeaderFrom: "sender@example.com", MailData: signWithBodyLength(t, key, "h=from:subject")}
+	zone := &resolver.Zone{TXT: map[string][]string{"long._domainkey.example.com": {record}}}
+
+	allow := checks.DkimCheck{MinRSABits: 1024, BodyLength: checks.DkimAllow, Resolver: zone}
+	result := allow.Validate(context.Background(), values)
+	assert.Equal(t, []check.Symbol{{Name: "DKIM_PASS", Score: 0}}, result.Symbols)
+	assert.Equal(t, int64(5), *result.Auth.DKIM.Signatures[0].BodyLength)
+
+	// Appended content still verifies, the l= tag does not cover it.
+	values.MailData += "Click here\r\n"
+	penalize := checks.DkimCheck{MinRSABits: 1024, BodyLength: checks.DkimPenalize, Resolver: zone}
+	result = penalize.Validate(context.Background(), values)
+	assert.Equal(t, []check.Symbol{{Name: "DKIM_PASS", Score: 0}, {Name: "DKIM_BODY_LENGTH", Score: 1.5}}, result.Symbols)
+
+	fail := checks.DkimCheck{MinRSABits: 1024, BodyLength: checks.DkimFail, Resolver: zone}
+	result = fail.Validate(context.Background(), values)
+	assert.EqualValues(t, authres.ResultPolicy, result.Auth.DKIM.Signatures[0].Value)
+	assert.Equal(t, "body length limit", result.Auth.DKIM.Signatures[0].Reason)
+}
+
+func TestDkimBodyLengthChecks(t *testing.T) {
+	key, record := rsaKey(t, 1024)
+	weakKey, weakRecord := rsaKey(t, 512)
+	tests := map[string]struct {
+		key    *rsa.PrivateKey
+		record string
+		tags   string
+	}{
+		"unsigned From":   {key, record, "h=subject"},
+		"expired":         {key, record, "h=from:subject; t=1000000000; x=1000000100"},
+		"foreign i=":      {key, record, "h=from:subject; i=@example.net"},
+		"strict key":      {key, record + "; t=s", "h=from:subject; i=@mail.example.com"},
+		"sha1-only key":   {key, record + "; h=sha1", "h=from:subject"},
+		"512-bit RSA key": {weakKey, weakRecord, "h=from:subject"},
+	}
+	for name, test := range tests {
+		zone := &resolver.Zone{TXT: map[string][]string{"long._domainkey.example.com": {test.record}}}
+		values := check.CheckValues{HeaderFrom: "sender@example.com", MailData: signWithBodyLength(t, test.key, test.tags)}
+		allow := checks.DkimCheck{MinRSABits: 1024, BodyLength: checks.DkimAllow, Resolver: zone}
+		result := allow.Validate(context.Background(), values)
+		assert.Equal(t, "DKIM_FAIL", result.Symbols[0].Name, name)
+		assert.EqualValues(t, authres.ResultFail, result.Auth.DKIM.Signatures[0].Value, name)
+	}
+
+	zone := &resolver.Zone{ServFail: map[string]bool{"long._domainkey.example.com": true}}
+	values := check.CheckValues{HeaderFrom: "sender@example.com", MailData: signWithBodyLength(t, key, "h=from:subject")}
+	result := checks.DkimCheck{MinRSABits: 1024, Resolver: zone}.Validate(context.Background(), values)
+	assert.EqualValues(t, authres.ResultTempError, result.Auth.DKIM.Signatures[0].Value)
+}
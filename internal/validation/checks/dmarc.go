@@ -2,73 +2,113 @@ package checks
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dmarc"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/publicsuffix"
 )
 
-// DMARC relies on the results of SPF and DKIM, therefore we cannot implement this the same way we implement the other checks.
-
-type DmarcCheck struct{}
+// DmarcCheck relies on the results of SPF and DKIM, and ARC for overrides, so it runs after those checks.
+type DmarcCheck struct {
+	// Resolver looks up the DMARC records, resolver.Default when nil.
+	Resolver resolver.Resolver
+}
 
 func (c DmarcCheck) Name() string {
   return "dmarc"
 }
 
-func (c DmarcCheck) Validate(ctx context.Context, values check.CheckValues, state map[string]any) check.CheckResult {
+func (c DmarcCheck) Requires() []check.Part {
+	return []check.Part{check.PartSPF, check.PartDKIM, check.PartARC}
+}
+
+func (c DmarcCheck) Provides() []check.Part {
+	return []check.Part{check.PartDMARC}
+}
+
+// Validate evaluates DMARC as described in RFC 7489 section 6.6.
+func (c DmarcCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
 	split := strings.Split(values.HeaderFrom, "@")
 	if len(split) != 2 {
 		return check.CheckResult{
 			Message: fmt.Sprintf("headerFrom split failed: %v", values.HeaderFrom),
 			Success: false,
-			Reject:  true,
+			Symbols: []check.Symbol{{Name: "DMARC_BAD_FROM", Score: 15}},
 		}
 	}
+	headerFromDomain := strings.ToLower(strings.TrimSuffix(split[1], "."))
 
-	split2 := strings.Split(values.EnvelopeFrom, "@")
-	if len(split2) != 2 {
+	// SPF and DKIM were cancelled.
+	if values.Auth.SPF == nil || values.Auth.DKIM == nil {
 		return check.CheckResult{
-			Message: fmt.Sprintf("envelopeFrom split failed: %v", values.EnvelopeFrom),
-			Success: false,
-			Reject:  true,
+			Message: "state is missing",
+			Symbols: []check.Symbol{{Name: "DMARC_STATE_MISSING", Score: 15}},
 		}
 	}
+	spfPass := values.Auth.SPF.Value == authres.ResultPass
+	passing := values.Auth.DKIM.Passing()
+	dkimPass := len(passing) > 0
 
-	headerFromDomain := split[1]
-	envelopeFromDomain := split2[1]
-	result, err := dmarc.Lookup(headerFromDomain)
+	// A trusted forwarder saw DMARC pass before the message was changed on the way (RFC 7489 section 7.2.2, trusted_forwarder).
+	arcOverride := values.Auth.ARC != nil && values.Auth.ARC.Override
 
-	val, ok := state["dkim_pass"]
-	val2, ok2 := state["spf_pass"]
-	if !ok || !ok2 {
+	result := &check.DMARCResult{Value: authres.ResultFail, From: headerFromDomain}
+	record, policyDomain, err := c.lookup(ctx, headerFromDomain)
+	switch {
+	case isTempError(err):
+		logrus.Debugf("dmarc lookup for %v failed temporarily: %v", headerFromDomain, err)
+		result.Value = authres.ResultTempError
 		return check.CheckResult{
-			Message: "state is missing",
-			Reject:  true,
+			Message: fmt.Sprintf("DMARC lookup failed: %v", err),
+			Symbols: []check.Symbol{{Name: "DMARC_TEMPFAIL", Score: 0, Tempfail: true}},
+			Auth:    check.AuthResults{DMARC: result},
+		}
+	case err != nil:
+		result.Value = authres.ResultNone
+		message := "no DMARC record"
+		if err != errNoDmarcRecord {
+			result.Value = authres.ResultPermError
+			message = fmt.Sprintf("invalid DMARC record: %v", err)
+		}
+		if spfPass && dkimPass {
+			return check.CheckResult{
+				Success: true,
+				Message: message,
+				Symbols: []check.Symbol{{Name: "DMARC_NA", Score: 0}},
+				Auth:    check.AuthResults{DMARC: result},
+			}
+		}
+		if arcOverride {
+			return c.override(result)
 		}
-	}
-	dkimPass := val.(bool)
-	spfPass := val2.(bool)
-
-	if err != nil && (!spfPass || !dkimPass) {
 		logrus.Debugf("dmarc error: %v for address: %v(%v), spf pass: %v dkim pass: %v", err, values.EnvelopeFrom, values.HeaderFrom, spfPass, dkimPass)
 		return check.CheckResult{
 			Message: "SPF or DKIM failed, with DMARC failing too",
-			Reject:  true,
+			Symbols: []check.Symbol{{Name: "DMARC_NA_AUTH_FAIL", Score: 6}},
+			Auth:    check.AuthResults{DMARC: result},
 		}
 	}
-
-	var dkimDomain string
-	val, ok = state["dkim_domain"]
-	if ok {
-		dkimDomain = val.(string)
+	result.Record = record
+	result.PolicyDomain = policyDomain
+	result.Policy = record.Policy
+	if policyDomain != headerFromDomain && record.SubdomainPolicy != "" {
+		result.Policy = record.SubdomainPolicy
 	}
 
-	dkimAligned := c.isAligned(headerFromDomain, dkimDomain, result.DKIMAlignment)
-	spfAligned := c.isAligned(headerFromDomain, envelopeFromDomain, result.SPFAlignment)
+	for _, v := range passing {
+		if isAligned(headerFromDomain, v.Domain, record.DKIMAlignment) {
+			result.DKIMAligned = true
+		}
+	}
+	// The SPF domain is the HELO name for the null sender.
+	result.SPFAligned = spfPass && isAligned(headerFromDomain, values.Auth.SPF.Domain(), record.SPFAlignment)
 
 	/*
 
@@ -78,11 +118,30 @@ func (c DmarcCheck) Validate(ctx context.Context, values check.CheckValues, stat
 		If both SPF and DKIM FAILED = DMARC FAIL
 	*/
 
-	if (spfAligned && spfPass) || (dkimAligned && dkimPass) {
+	if result.SPFAligned || result.DKIMAligned {
 		logrus.Debugf("DMARC pass for address: %v(%v)", values.EnvelopeFrom, values.HeaderFrom)
+		result.Value = authres.ResultPass
 		return check.CheckResult{
 			Success: true,
 			Message: "DMARC pass",
+			Symbols: []check.Symbol{{Name: "DMARC_PASS", Score: 0}},
+			Auth:    check.AuthResults{DMARC: result},
+		}
+	}
+
+	if arcOverride {
+		return c.override(result)
+	}
+
+	// pct= applies the policy to a share of the failing mail only, the rest gets the next less strict one (section 6.6.4).
+	if record.Percent != nil && rand.Intn(100) >= *record.Percent {
+		switch result.Policy {
+		case dmarc.PolicyReject:
+			result.Policy = dmarc.PolicyQuarantine
+			result.Reason = "sampled_out"
+		case dmarc.PolicyQuarantine:
+			result.Policy = dmarc.PolicyNone
+			result.Reason = "sampled_out"
 		}
 	}
 
@@ -90,30 +149,101 @@ func (c DmarcCheck) Validate(ctx context.Context, values check.CheckValues, stat
 	case dmarc.PolicyNone:
 		// for now, we are quarantining this.
 		return check.CheckResult{
-			Message:    "DMARC pass",
-			Quarantine: true,
+			Message: "DMARC fail with policy none",
+			Symbols: []check.Symbol{{Name: "DMARC_POLICY_NONE", Score: 6}},
+			Auth:    check.AuthResults{DMARC: result},
 		}
 	case dmarc.PolicyQuarantine:
 		return check.CheckResult{
-			Message:    "quarantine",
-			Quarantine: true,
+			Message: "quarantine",
+			Symbols: []check.Symbol{{Name: "DMARC_POLICY_QUARANTINE", Score: 6}},
+			Auth:    check.AuthResults{DMARC: result},
 		}
 	case dmarc.PolicyReject:
 		return check.CheckResult{
 			Success: false,
 			Message: "DMARC reject",
-			Reject:  true,
+			Symbols: []check.Symbol{{Name: "DMARC_POLICY_REJECT", Score: 15}},
+			Auth:    check.AuthResults{DMARC: result},
 		}
 	default:
 		return check.CheckResult{
 			Success: false,
-			Reject:  true,
+			Symbols: []check.Symbol{{Name: "DMARC_POLICY_UNKNOWN", Score: 15}},
+		}
+	}
+}
+
+func (c DmarcCheck) override(result *check.DMARCResult) check.CheckResult {
+	logrus.Debugf("DMARC fail for %v overridden by trusted ARC chain", result.From)
+	result.Reason = "trusted_forwarder"
+	return check.CheckResult{
+		Success: true,
+		Message: "DMARC fail overridden by trusted ARC chain",
+		Symbols: []check.Symbol{{Name: "DMARC_ARC_OVERRIDE", Score: 0}},
+		Auth:    check.AuthResults{DMARC: result},
+	}
+}
+
+var errNoDmarcRecord = errors.New("no DMARC record")
+
+// lookup discovers the DMARC record for domain (RFC 7489 section 6.6.3): at the domain itself, or else at its
+// organizational domain. It returns the record and the domain it was found at.
+func (c DmarcCheck) lookup(ctx context.Context, domain string) (*dmarc.Record, string, error) {
+	record, err := c.lookupRecord(ctx, domain)
+	if err != errNoDmarcRecord {
+		return record, domain, err
+	}
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil || strings.EqualFold(orgDomain, domain) {
+		return nil, "", errNoDmarcRecord
+	}
+	record, err = c.lookupRecord(ctx, orgDomain)
+	return record, orgDomain, err
+}
+
+func (c DmarcCheck) lookupRecord(ctx context.Context, domain string) (*dmarc.Record, error) {
+	txts, err := resolver.OrDefault(c.Resolver).LookupTXT(ctx, "_dmarc."+domain)
+	if resolver.IsNotFound(err) {
+		return nil, errNoDmarcRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Other TXT records may live at the same name. More than one DMARC record is as good as none.
+	var records []string
+	for _, v := range txts {
+		if strings.HasPrefix(v, "v=DMARC1") {
+			records = append(records, v)
 		}
 	}
+	if len(records) != 1 {
+		return nil, errNoDmarcRecord
+	}
+	record, err := dmarc.Parse(records[0])
+	if err != nil {
+		return nil, &dmarcRecordError{err}
+	}
+	return record, nil
+}
+
+// dmarcRecordError is a DMARC record that does not parse, a permanent error.
+type dmarcRecordError struct {
+	err error
+}
+
+func (e *dmarcRecordError) Error() string {
+	return e.err.Error()
+}
+
+// isTempError reports whether err is a DNS failure that might go away when trying again.
+func isTempError(err error) bool {
+	var recordErr *dmarcRecordError
+	return err != nil && err != errNoDmarcRecord && !errors.As(err, &recordErr)
 }
 
 // credit: maddy
-func (c *DmarcCheck) isAligned(fromDomain, authDomain string, mode dmarc.AlignmentMode) bool {
+func isAligned(fromDomain, authDomain string, mode dmarc.AlignmentMode) bool {
 
 	if mode == dmarc.AlignmentStrict {
 		return strings.EqualFold(fromDomain, authDomain)
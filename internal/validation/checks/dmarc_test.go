@@ -0,0 +1,72 @@
+package checks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/validation/checks"
+	"github.com/stretchr/testify/assert"
+)
+
+func dmarcValues(from string, spf authres.ResultValue, dkimDomain string) check.CheckValues {
+	dkimResult := &check.DKIMResult{}
+	if dkimDomain != "" {
+		dkimResult.Signatures = []check.DKIMSignature{{Value: authres.ResultPass, Domain: dkimDomain}}
+	}
+	return check.CheckValues{
+		HeaderFrom:   from,
+		EnvelopeFrom: "bounces@mailer.example.net",
+		Auth: check.AuthResults{
+			SPF:  &check.SPFResult{Value: spf, MailFrom: "bounces@mailer.example.net"},
+			DKIM: dkimResult,
+		},
+	}
+}
+
+func TestDmarcPolicy(t *testing.T) {
+	zone := &resolver.Zone{TXT: map[string][]string{
+		"_dmarc.example.com": {"google-site-verification=abc", "v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.sampled.org": {"v=DMARC1; p=reject; pct=0"},
+		"_dmarc.strict.org":  {"v=DMARC1; p=reject; adkim=s"},
+		"_dmarc.twice.org":   {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	}}
+	c := checks.DmarcCheck{Resolver: zone}
+
+	result := c.Validate(context.Background(), dmarcValues("user@example.com", authres.ResultFail, ""))
+	assert.Equal(t, []check.Symbol{{Name: "DMARC_POLICY_REJECT", Score: 15}}, result.Symbols)
+	assert.EqualValues(t, authres.ResultFail, result.Auth.DMARC.Value)
+
+	// A subdomain without a record of its own gets the sp= of the organizational domain.
+	result = c.Validate(context.Background(), dmarcValues("user@news.example.com", authres.ResultFail, ""))
+	assert.Equal(t, "DMARC_POLICY_QUARANTINE", result.Symbols[0].Name)
+	assert.Equal(t, "example.com", result.Auth.DMARC.PolicyDomain)
+
+	// Relaxed alignment accepts a signature of the organizational domain.
+	result = c.Validate(context.Background(), dmarcValues("user@news.example.com", authres.ResultFail, "example.com"))
+	assert.Equal(t, "DMARC_PASS", result.Symbols[0].Name)
+	assert.True(t, result.Auth.DMARC.DKIMAligned)
+
+	result = c.Validate(context.Background(), dmarcValues("user@mail.strict.org", authres.ResultFail, "strict.org"))
+	assert.Equal(t, "DMARC_POLICY_REJECT", result.Symbols[0].Name)
+
+	result = c.Validate(context.Background(), dmarcValues("user@sampled.org", authres.ResultFail, ""))
+	assert.EqualValues(t, dmarc.PolicyQuarantine, result.Auth.DMARC.Policy)
+	assert.Equal(t, "sampled_out", result.Auth.DMARC.Reason)
+
+	result = c.Validate(context.Background(), dmarcValues("user@twice.org", authres.ResultFail, ""))
+	assert.EqualValues(t, authres.ResultNone, result.Auth.DMARC.Value)
+
+	result = c.Validate(context.Background(), dmarcValues("user@unknown.org", authres.ResultPass, "unknown.org"))
+	assert.Equal(t, "DMARC_NA", result.Symbols[0].Name)
+}
+
+func TestDmarcTempError(t *testing.T) {
+	c := checks.DmarcCheck{Resolver: &resolver.Zone{ServFail: map[string]bool{"_dmarc.example.com": true}}}
+	result := c.Validate(context.Background(), dmarcValues("user@example.com", authres.ResultFail, ""))
+	assert.EqualValues(t, authres.ResultTempError, result.Auth.DMARC.Value)
+	assert.True(t, result.Symbols[0].Tempfail)
+}
@@ -6,20 +6,29 @@ import (
 	"net"
 	"strings"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/sirupsen/logrus"
 )
 
-type ReverseDnsCheck struct{}
+type ReverseDnsCheck struct {
+	// Resolver looks up the PTR records and the addresses they point to, resolver.Default when nil.
+	Resolver resolver.Resolver
+}
 
 func (c ReverseDnsCheck) Name() string {
   return "reversedns"
 }
 
+func (c ReverseDnsCheck) Provides() []check.Part {
+	return []check.Part{check.PartIPRev}
+}
+
 func (c ReverseDnsCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
 	resultChan := make(chan check.CheckResult, 1)
 	go func() {
-		result := c.runCheck(values)
+		result := c.runCheck(ctx, values)
 		resultChan <- result
 	}()
 	select {
@@ -33,26 +42,56 @@ func (c ReverseDnsCheck) Validate(ctx context.Context, values check.CheckValues)
 	}
 }
 
-func (c ReverseDnsCheck) runCheck(values check.CheckValues) check.CheckResult {
-	ptrs, err := net.LookupAddr(values.Ip.String())
+func (c ReverseDnsCheck) runCheck(ctx context.Context, values check.CheckValues) check.CheckResult {
+	ptrs, err := resolver.OrDefault(c.Resolver).LookupAddr(ctx, values.Ip.String())
 	if err != nil {
+		symbol := check.Symbol{Name: "RDNS_NONE", Score: 3}
+		if !resolver.IsNotFound(err) {
+			// Only a missing PTR record counts against the sender, the sender can try again once DNS answers.
+			symbol = check.Symbol{Name: "RDNS_TEMPERROR", Score: 0, Tempfail: true}
+		}
 		return check.CheckResult{
 			Success: false,
-			Reject:  true,
 			Message: fmt.Sprintf("address lookup error: %v", err.Error()),
+			Symbols: []check.Symbol{symbol},
+			Auth:    check.AuthResults{IPRev: &check.IPRevResult{Value: iprevErrorValue(err), IP: values.Ip}},
 		}
 	}
 	ptrRecord := strings.TrimSuffix(ptrs[0], ".")
+	auth := check.AuthResults{IPRev: &check.IPRevResult{Value: c.forwardConfirm(ctx, ptrRecord, values.Ip), IP: values.Ip, PTR: ptrRecord}}
 	if ptrRecord != values.Helo {
 		logrus.Debugf("PTR record %v does not match hostname %v", ptrRecord, values.Helo)
 		return check.CheckResult{
 			Success: false,
-			Reject:  false,
 			Message: fmt.Sprintf("PTR record(%v) does not match helo(%v)", ptrRecord, values.Helo),
+			Symbols: []check.Symbol{{Name: "RDNS_HELO_MISMATCH", Score: 0.5}},
+			Auth:    auth,
 		}
 	}
 	return check.CheckResult{
 		Success: true,
 		Message: "PTR record matches hostname",
+		Auth:    auth,
+	}
+}
+
+// forwardConfirm returns the iprev result (RFC 8601 section 3): pass when the PTR name resolves back to ip.
+func (c ReverseDnsCheck) forwardConfirm(ctx context.Context, ptr string, ip net.IP) authres.ResultValue {
+	addrs, err := resolver.OrDefault(c.Resolver).LookupIPAddr(ctx, ptr)
+	if err != nil {
+		return iprevErrorValue(err)
+	}
+	for _, v := range addrs {
+		if v.IP.Equal(ip) {
+			return authres.ResultPass
+		}
+	}
+	return authres.ResultFail
+}
+
+func iprevErrorValue(err error) authres.ResultValue {
+	if resolver.IsNotFound(err) {
+		return authres.ResultPermError
 	}
+	return authres.ResultTempError
 }
@@ -5,18 +5,77 @@ import (
 	"net"
 	"testing"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/maskrapp/relay/internal/validation/checks"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestReverseDNS(t *testing.T) {
-	c := checks.ReverseDnsCheck{}
+	c := checks.ReverseDnsCheck{Resolver: &resolver.Zone{
+		PTR: map[string][]string{"192.0.2.1": {"mail.example.com."}, "192.0.2.2": {"forged.example.com."}},
+		IP:  map[string][]net.IP{"mail.example.com": {net.ParseIP("192.0.2.1")}},
+	}}
 	values := check.CheckValues{
-		Ip:   net.ParseIP("209.85.221.51"),
-		Helo: "mail-wr1-f51.google.com",
+		Ip:   net.ParseIP("192.0.2.1"),
+		Helo: "mail.example.com",
 	}
 
 	result := c.Validate(context.Background(), values)
 	assert.Equal(t, true, result.Success)
+	assert.EqualValues(t, authres.ResultPass, result.Auth.IPRev.Value)
+
+	values.Ip = net.ParseIP("192.0.2.2")
+	result = c.Validate(context.Background(), values)
+	assert.Equal(t, "RDNS_HELO_MISMATCH", result.Symbols[0].Name)
+	assert.EqualValues(t, authres.ResultPermError, result.Auth.IPRev.Value)
+
+	values.Ip = net.ParseIP("192.0.2.3")
+	result = c.Validate(context.Background(), values)
+	assert.Equal(t, "RDNS_NONE", result.Symbols[0].Name)
+	assert.False(t, result.Symbols[0].Tempfail)
+
+	// A DNS outage is not held against the sender.
+	c.Resolver.(*resolver.Zone).ServFail = map[string]bool{"192.0.2.4": true}
+	values.Ip = net.ParseIP("192.0.2.4")
+	result = c.Validate(context.Background(), values)
+	assert.Equal(t, "RDNS_TEMPERROR", result.Symbols[0].Name)
+	assert.Zero(t, result.Symbols[0].Score)
+	assert.True(t, result.Symbols[0].Tempfail)
+}
+
+func TestReverseDNSForwardConfirm(t *testing.T) {
+	c := checks.ReverseDnsCheck{Resolver: &resolver.Zone{
+		PTR: map[string][]string{
+			"192.0.2.1": {"mail.example.com."},
+			"192.0.2.2": {"moved.example.com."},
+			"192.0.2.3": {"broken.example.com."},
+		},
+		IP: map[string][]net.IP{
+			"mail.example.com":  {net.ParseIP("192.0.2.1")},
+			"moved.example.com": {net.ParseIP("198.51.100.1")},
+		},
+		ServFail: map[string]bool{"broken.example.com": true, "192.0.2.4": true},
+	}}
+	tests := map[string]struct {
+		ip       string
+		expected authres.ResultValue
+		ptr      string
+	}{
+		"confirmed":              {"192.0.2.1", authres.ResultPass, "mail.example.com"},
+		"points elsewhere":       {"192.0.2.2", authres.ResultFail, "moved.example.com"},
+		"forward lookup failing": {"192.0.2.3", authres.ResultTempError, "broken.example.com"},
+		"reverse lookup failing": {"192.0.2.4", authres.ResultTempError, ""},
+		"no reverse record":      {"192.0.2.5", authres.ResultPermError, ""},
+	}
+	for name, test := range tests {
+		values := check.CheckValues{Ip: net.ParseIP(test.ip), Helo: "mail.example.com"}
+		result := c.Validate(context.Background(), values)
+		if assert.NotNil(t, result.Auth.IPRev, name) {
+			assert.EqualValues(t, test.expected, result.Auth.IPRev.Value, name)
+			assert.True(t, values.Ip.Equal(result.Auth.IPRev.IP), name)
+			assert.Equal(t, test.ptr, result.Auth.IPRev.PTR, name)
+		}
+	}
 }
@@ -5,19 +5,28 @@ import (
 	"fmt"
 
 	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
 )
 
-type SpfCheck struct{}
+type SpfCheck struct {
+	// Resolver looks up the SPF records, the resolver of the spf package when nil.
+	Resolver resolver.Resolver
+}
 
 func (c SpfCheck) Name() string {
 	return "spf"
 }
 
+func (c SpfCheck) Provides() []check.Part {
+	return []check.Part{check.PartSPF}
+}
+
 func (c SpfCheck) Validate(ctx context.Context, values check.CheckValues) check.CheckResult {
 	resultChan := make(chan check.CheckResult, 1)
 	go func() {
-		result := c.runCheck(values)
+		result := c.runCheck(ctx, values)
 		resultChan <- result
 	}()
 	select {
@@ -31,22 +40,46 @@ func (c SpfCheck) Validate(ctx context.Context, values check.CheckValues) check.
 	}
 }
 
-func (c SpfCheck) runCheck(values check.CheckValues) check.CheckResult {
-	result, _ := spf.CheckHostWithSender(values.Ip, values.Helo, values.EnvelopeFrom)
-	if result != spf.Pass {
-		return check.CheckResult{
-			Message: fmt.Sprintf("expected pass, but got %v", result),
-			Success: false,
-			Data: map[string]any{
-				"spf_pass": false,
-			},
-		}
+func (c SpfCheck) runCheck(ctx context.Context, values check.CheckValues) check.CheckResult {
+	// The null sender is checked with the HELO identity, as postmaster@<helo> (RFC 7208 section 2.4).
+	sender := values.EnvelopeFrom
+	if sender == "" {
+		sender = "postmaster@" + values.Helo
 	}
+	options := []spf.Option{spf.WithContext(ctx)}
+	if c.Resolver != nil {
+		options = append(options, spf.WithResolver(c.Resolver))
+	}
+	result, err := spf.CheckHostWithSender(values.Ip, values.Helo, sender, options...)
+	spfResult := &check.SPFResult{Value: authres.ResultValue(result), MailFrom: values.EnvelopeFrom, Helo: values.Helo, IP: values.Ip}
+	if result == spf.TempError || result == spf.PermError {
+		spfResult.Err = err
+	}
+	symbol := spfSymbol(result)
 	return check.CheckResult{
-		Message: "SPF pass",
-		Success: true,
-		Data: map[string]any{
-			"spf_pass": true,
-		},
+		Message: fmt.Sprintf("SPF %v", result),
+		Success: result == spf.Pass,
+		Symbols: []check.Symbol{symbol},
+		Auth:    check.AuthResults{SPF: spfResult},
+	}
+}
+
+func spfSymbol(result spf.Result) check.Symbol {
+	switch result {
+	case spf.Pass:
+		return check.Symbol{Name: "SPF_PASS", Score: 0}
+	case spf.Fail:
+		return check.Symbol{Name: "SPF_FAIL", Score: 3}
+	case spf.SoftFail:
+		return check.Symbol{Name: "SPF_SOFTFAIL", Score: 1.5}
+	case spf.Neutral:
+		return check.Symbol{Name: "SPF_NEUTRAL", Score: 0.5}
+	case spf.TempError:
+		// The sender can try again once DNS answers.
+		return check.Symbol{Name: "SPF_TEMPERROR", Score: 0, Tempfail: true}
+	case spf.PermError:
+		return check.Symbol{Name: "SPF_PERMERROR", Score: 2}
+	default:
+		return check.Symbol{Name: "SPF_NONE", Score: 1}
 	}
 }
@@ -0,0 +1,51 @@
+package checks_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/check"
+	"github.com/maskrapp/relay/internal/resolver"
+	"github.com/maskrapp/relay/internal/validation/checks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpfResults(t *testing.T) {
+	c := checks.SpfCheck{Resolver: &resolver.Zone{
+		TXT: map[string][]string{
+			"example.com":      {"v=spf1 ip4:192.0.2.1 -all"},
+			"soft.example.com": {"v=spf1 ~all"},
+			"mail.example.net": {"v=spf1 ip4:192.0.2.1 -all"},
+			"broken.example":   {"v=spf1 include:"},
+		},
+		ServFail: map[string]bool{"flaky.example": true},
+	}}
+	tests := []struct {
+		from   string
+		helo   string
+		ip     string
+		symbol string
+	}{
+		{"user@example.com", "mail.example.com", "192.0.2.1", "SPF_PASS"},
+		{"user@example.com", "mail.example.com", "192.0.2.2", "SPF_FAIL"},
+		{"user@soft.example.com", "mail.example.com", "192.0.2.1", "SPF_SOFTFAIL"},
+		{"user@unknown.example", "mail.example.com", "192.0.2.1", "SPF_NONE"},
+		{"user@broken.example", "mail.example.com", "192.0.2.1", "SPF_PERMERROR"},
+		{"user@flaky.example", "mail.example.com", "192.0.2.1", "SPF_TEMPERROR"},
+		// The null sender falls back to the HELO identity.
+		{"", "mail.example.net", "192.0.2.1", "SPF_PASS"},
+	}
+	for _, test := range tests {
+		result := c.Validate(context.Background(), check.CheckValues{EnvelopeFrom: test.from, Helo: test.helo, Ip: net.ParseIP(test.ip)})
+		assert.Equal(t, test.symbol, result.Symbols[0].Name, test.from)
+		assert.Equal(t, test.symbol == "SPF_TEMPERROR", result.Symbols[0].Tempfail, test.from)
+	}
+}
+
+func TestReceivedSPF(t *testing.T) {
+	result := &check.SPFResult{Value: authres.ResultPass, Helo: "mail.example.net", IP: net.ParseIP("192.0.2.1")}
+	assert.Equal(t, `pass (mx.maskr.app: domain of postmaster@mail.example.net designates 192.0.2.1 as permitted sender) `+
+		`client-ip=192.0.2.1; envelope-from=""; helo=mail.example.net; receiver=mx.maskr.app; identity=helo`, result.ReceivedSPF("mx.maskr.app"))
+}
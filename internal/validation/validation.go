@@ -2,99 +2,87 @@ package validation
 
 import (
 	"context"
-	"fmt"
-	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/maskrapp/relay/internal/arc"
 	"github.com/maskrapp/relay/internal/check"
 	"github.com/maskrapp/relay/internal/global"
+	"github.com/maskrapp/relay/internal/policy"
 	"github.com/maskrapp/relay/internal/rbl"
+	"github.com/maskrapp/relay/internal/resolver"
 	"github.com/maskrapp/relay/internal/validation/checks"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
 )
 
 type MailValidator struct {
-	checks []check.Check
+	graph    *check.Graph
+	hostname string
+	policy   *policy.Policy
 }
 
 type CheckResponse struct {
-	Reject     bool
-	Reason     string
-	Quarantine bool
+	Verdict policy.Verdict
+	// Auth holds the authentication results of all checks, AuthenticationResults formats them as issued by this relay.
+	Auth                  check.AuthResults
+	AuthenticationResults string
+	// ReceivedSPF is the value of the Received-SPF header for the message, empty when SPF did not run.
+	ReceivedSPF string
 }
 
 func NewValidator(ctx global.Context) *MailValidator {
-	var statelessChecks = []check.Check{
-		checks.SpfCheck{},
-		checks.DkimCheck{},
-		checks.ReverseDnsCheck{},
-		checks.BlacklistCheck{List: rbl.CreateRBL(ctx)},
+	dns := ctx.Instances().Resolver
+	// The order does not matter, checks declare the data they provide and require.
+	graph, err := check.NewGraph(
+		checks.SpfCheck{Resolver: dns},
+		checks.DkimCheck{
+			MinRSABits: ctx.Config().DKIM.MinRSABits,
+			WeakKeys:   checks.DkimPolicy(ctx.Config().DKIM.WeakKeys),
+			BodyLength: checks.DkimPolicy(ctx.Config().DKIM.BodyLength),
+			Resolver:   dns,
+		},
+		checks.ReverseDnsCheck{Resolver: dns},
+		checks.BlacklistCheck{List: rbl.CreateRBL(ctx), Resolver: ctx.Instances().DNSBLResolver},
+		checks.ArcCheck{Verifier: &arc.Verifier{Resolver: resolver.OrDefault(dns)}, TrustedSealers: ctx.Config().ARC.TrustedSealers},
+		checks.DmarcCheck{Resolver: dns},
+	)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	cfg := ctx.Config().Policy
+	return &MailValidator{
+		graph:    graph,
+		hostname: ctx.Config().Hostname,
+		policy: &policy.Policy{
+			TagScore:        cfg.TagScore,
+			QuarantineScore: cfg.QuarantineScore,
+			TempfailScore:   cfg.TempfailScore,
+			RejectScore:     cfg.RejectScore,
+			Weights:         cfg.Weights,
+		},
 	}
-	return &MailValidator{statelessChecks}
 }
 
-func (v *MailValidator) RunChecks(c context.Context, values check.CheckValues) CheckResponse {
-	stateMutex := sync.Mutex{}
-	state := make(map[string]interface{})
-	quarantine := atomic.Bool{}
-	var reject *struct {
-		Reason string
-	} = nil
-	once := sync.Once{}
-	eg, ctx := errgroup.WithContext(c)
+func (v *MailValidator) RunChecks(ctx context.Context, values check.CheckValues) CheckResponse {
 	start := time.Now()
-	for _, v := range v.checks {
-		value := v
-		logrus.Debugf("running check %v", v.Name())
-		eg.Go(func() error {
-			now := time.Now()
-			defer func() {
-				elapsed := time.Since(now)
-				logrus.Infof("finished check %v in %vms", value.Name(), elapsed.Milliseconds())
-			}()
-			result := value.Validate(ctx, values)
-			if result.Reject {
-				once.Do(func() {
-					reject = &struct{ Reason string }{
-						Reason: result.Message,
-					}
-				})
-				logrus.Infof("received reject from check %v with response: %v", value.Name(), result)
-				return fmt.Errorf("received reject from check %v", value.Name())
-			}
-			if result.Quarantine {
-				quarantine.Store(true)
-			}
-			stateMutex.Lock()
-			for k2, v2 := range result.Data {
-				state[k2] = v2
-			}
-			stateMutex.Unlock()
-			return nil
-		})
-	}
-	eg.Wait()
-	if reject != nil {
-		return CheckResponse{
-			Reject: true,
-			Reason: reject.Reason,
-		}
+	outcomes := v.graph.Run(ctx, values)
+	logrus.Debugf("Finished all checks in %vms", time.Since(start).Milliseconds())
+
+	var auth check.AuthResults
+	symbols := make(map[string][]check.Symbol)
+	for _, outcome := range outcomes {
+		auth.Merge(outcome.Result.Auth)
+		symbols[outcome.Name] = outcome.Result.Symbols
 	}
-	//TODO: implement the stateful checks properly
-	dmarcCheck := &checks.DmarcCheck{}
-	dmarcResult := dmarcCheck.Validate(ctx, values, state)
-	elapsed := time.Since(start)
-	logrus.Debugf("Finished all checks in %vms", elapsed.Milliseconds())
-	if dmarcResult.Reject {
-		return CheckResponse{
-			Reject: true,
-			Reason: dmarcResult.Message,
-		}
+	verdict := v.policy.Evaluate(symbols)
+	logrus.Infof("policy verdict: %v", verdict.Reason())
+	response := CheckResponse{
+		Verdict:               verdict,
+		Auth:                  auth,
+		AuthenticationResults: authres.Format(v.hostname, auth.Results()),
 	}
-	return CheckResponse{
-		Reject:     false,
-		Quarantine: quarantine.Load() || dmarcResult.Quarantine,
+	if auth.SPF != nil {
+		response.ReceivedSPF = auth.SPF.ReceivedSPF(v.hostname)
 	}
+	return response
 }
@@ -0,0 +1,5 @@
+module github.com/maskrapp/smtpd
+
+go 1.19
+
+require github.com/armon/go-proxyproto v0.0.0-20210323213023-7e956b284f0a